@@ -6,16 +6,47 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/ktoks/remote/internal/client"
+	"github.com/ktoks/remote/internal/config"
 	"github.com/ktoks/remote/internal/daemon"
 )
 
 var (
-	flagDaemon = flag.String("daemon", "", "Internal: run as daemon for identity")
-	flagBatch  = flag.Bool("batch", false, "Run in batch mode")
+	flagDaemon  = flag.String("daemon", "", "Internal: run as daemon for identity")
+	flagReadyFD = flag.Int("ready-fd", 0, "Internal: file descriptor to report daemon startup on")
+	flagBatch   = flag.Bool("batch", false, "Run in batch mode")
+	flagJSON    = flag.Bool("json", false, "Print one JSON object per command instead of its output")
+	flagEnv     = envFlag{}
+	flagTimeout = flag.Duration("timeout", 0, "Kill commands that run longer than this, e.g. 30s (the host may set a shorter limit)")
+	flagCwd     = flag.String("cwd", "", "Run commands in this remote directory")
+	flagScript  = flag.String("script", "", "Run a local script on the host; remaining arguments are passed to it")
+	flagHosts   = flag.String("hosts", "", "Run the command on several hosts at once: comma-separated names, globs (db*) or group names")
+
+	flagPush = flag.Bool("push", false, "Upload a file: --push <local file> <remote path>")
+	flagPull = flag.Bool("pull", false, "Download a file: --pull <remote file> [local path]")
+	flagSync = flag.Bool("sync", false, "Mirror a local directory onto the host: --sync <local dir> <remote dir>")
+
+	flagDelete   = flag.Bool("delete", false, "With --sync, remove remote files that don't exist locally")
+	flagChecksum = flag.Bool("checksum", false, "With --sync, compare file contents instead of size and modification time")
+	flagDryRun   = flag.Bool("dry-run", false, "With --sync, show what would change without transferring anything")
+
+	flagSerial  = flag.Int("serial", 0, "With --hosts, run this many hosts per batch (0 = all at once)")
+	flagMaxFail = flag.Int("max-fail", 100, "With --hosts, halt the rollout once more than this percentage of hosts has failed")
+	flagPause   = flag.Duration("pause", 0, "With --hosts, wait this long between batches")
+
+	flagForward       = flag.String("forward", "", "Forward a local port through the master: [bind_address:]port:host:hostport")
+	flagRemoteForward = flag.String("remote-forward", "", "Forward a remote port back to this machine: [bind_address:]port:host:hostport")
+	flagDynamic       = flag.String("dynamic", "", "Serve a local SOCKS5 proxy through the master: [bind_address:]port")
+	flagListForwards  = flag.Bool("forwards", false, "List active port forwards")
+	flagCancelForward = flag.Int("cancel-forward", 0, "Cancel the port forward with this ID")
 )
 
+func init() {
+	flag.Var(flagEnv, "env", "Set an environment variable for remote commands: NAME=value (repeatable)")
+}
+
 func main() {
 	flag.Parse()
 
@@ -26,15 +57,95 @@ func main() {
 
 	// 1. Daemon Mode
 	if *flagDaemon != "" {
-		daemon.Start(*flagDaemon, *flagDaemon, home)
+		var ready *os.File
+		if *flagReadyFD > 0 {
+			ready = os.NewFile(uintptr(*flagReadyFD), "ready")
+		}
+		if *flagDaemon == config.AgentIdentity {
+			daemon.StartAgent(home, ready)
+			return
+		}
+		daemon.Start(*flagDaemon, *flagDaemon, home, ready)
 		return
 	}
 
 	// 2. Client Mode
 	linkName := filepath.Base(os.Args[0])
+	args := flag.Args()
+	opts := client.Options{Batch: *flagBatch, JSON: *flagJSON, Timeout: *flagTimeout, Env: flagEnv, Dir: *flagCwd}
 
-	if err := client.Run(linkName, linkName, *flagBatch, flag.Args()); err != nil {
+	switch {
+	case *flagHosts != "":
+		err = client.RunHosts(*flagHosts, args, opts, client.RolloutOptions{
+			Serial:         *flagSerial,
+			MaxFailPercent: *flagMaxFail,
+			Pause:          *flagPause,
+		})
+	case *flagScript != "":
+		err = client.RunScript(linkName, *flagScript, args, opts)
+	case *flagForward != "":
+		err = client.LocalForward(linkName, *flagForward)
+	case *flagRemoteForward != "":
+		err = client.RemoteForward(linkName, *flagRemoteForward)
+	case *flagDynamic != "":
+		err = client.DynamicForward(linkName, *flagDynamic)
+	case *flagListForwards:
+		err = client.ListForwards(linkName)
+	case *flagCancelForward > 0:
+		err = client.CancelForward(linkName, *flagCancelForward)
+	case *flagPush:
+		if len(args) != 2 {
+			usageError("usage: %s --push <local file> <remote path>", linkName)
+		}
+		err = client.Push(linkName, args[0], args[1])
+	case *flagPull:
+		if len(args) < 1 || len(args) > 2 {
+			usageError("usage: %s --pull <remote file> [local path]", linkName)
+		}
+		local := ""
+		if len(args) == 2 {
+			local = args[1]
+		}
+		err = client.Pull(linkName, args[0], local)
+	case *flagSync:
+		if len(args) != 2 {
+			usageError("usage: %s --sync [--delete] [--checksum] [--dry-run] <local dir> <remote dir>", linkName)
+		}
+		err = client.Sync(linkName, args[0], args[1], client.SyncOptions{
+			Delete:   *flagDelete,
+			Checksum: *flagChecksum,
+			DryRun:   *flagDryRun,
+		})
+	default:
+		err = client.Run(linkName, linkName, args, opts)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+func usageError(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
+
+// envFlag collects repeated --env NAME=value flags.
+type envFlag map[string]string
+
+func (e envFlag) String() string {
+	pairs := make([]string, 0, len(e))
+	for name, value := range e {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (e envFlag) Set(kv string) error {
+	name, value, ok := strings.Cut(kv, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=value, got %q", kv)
+	}
+	e[name] = value
+	return nil
+}
@@ -3,8 +3,11 @@ module github.com/ktoks/remote
 go 1.25.5
 
 require (
+	github.com/pkg/sftp v1.13.10
 	golang.org/x/crypto v0.45.0
 	golang.org/x/sys v0.38.0
+	golang.org/x/term v0.37.0
+	mvdan.cc/sh/v3 v3.12.0
 )
 
-require mvdan.cc/sh/v3 v3.12.0 // indirect
+require github.com/kr/fs v0.1.0 // indirect
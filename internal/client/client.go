@@ -2,12 +2,12 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -17,16 +17,79 @@ import (
 	"github.com/ktoks/remote/internal/protocol"
 )
 
-// Run processes the client request (Single or Batch).
-func Run(linkName, host string, batchMode bool, args []string) error {
+// Options control how commands are run.
+type Options struct {
+	Batch   bool          // Read commands from stdin, one per line
+	JSON    bool          // Print one JSON object per command instead of its output
+	Timeout time.Duration // Kill commands running longer than this; zero leaves it to the host
+	Env     map[string]string
+	SendEnv map[string]string // From the host's send_env; sent on a best-effort basis
+	Dir     string            // Remote working directory
+}
+
+// request builds the request frame for cmd.
+func (o Options) request(cmd string) protocol.Request {
+	return protocol.Request{Command: cmd, Options: protocol.RequestOptions{
+		TimeoutMS: o.Timeout.Milliseconds(),
+		Env:       o.Env,
+		SendEnv:   o.SendEnv,
+		Dir:       o.Dir,
+	}}
+}
+
+// withHostEnv returns opts with the local variables named by the host's
+// send_env that its policy allows. Like OpenSSH's SendEnv these are only
+// offered: unlike --env, one the host refuses doesn't fail the command.
+// Explicit values take precedence.
+func withHostEnv(cfg *config.Config, host string, opts Options) Options {
+	hostCfg := cfg.GetHostConfig(host)
+	if len(hostCfg.SendEnv) == 0 {
+		return opts
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if _, explicit := opts.Env[name]; explicit {
+			continue
+		}
+		if config.MatchEnv(hostCfg.SendEnv, name) && hostCfg.IsEnvAllowed(name) {
+			env[name] = value
+		}
+	}
+	opts.SendEnv = env
+	return opts
+}
+
+// loadConfig loads the same configuration the daemons use.
+func loadConfig() (*config.Config, error) {
 	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return config.Load(homeDir)
+}
+
+// Run processes the client request (Single or Batch).
+func Run(linkName, host string, args []string, opts Options) error {
+	cfg, err := loadConfig()
 	if err != nil {
 		return err
 	}
+	opts = withHostEnv(cfg, host, opts)
 
-	socketPath := config.ResolveSocketPath(homeDir, linkName)
-	conn, err := connectOrSpawn(socketPath, linkName)
+	start := time.Now()
+	conn, err := connect(linkName)
 	if err != nil {
+		if opts.JSON {
+			// Scripts reading --json still get a record saying why
+			var cmd string
+			if !opts.Batch {
+				cmd = strings.Join(args, " ")
+			}
+			var out capture
+			printRecord(out.record(host, cmd, hostResult{host: host, code: 255, err: err, start: start, end: time.Now()}))
+			os.Exit(255)
+		}
 		return err
 	}
 	defer func() {
@@ -35,53 +98,128 @@ func Run(linkName, host string, batchMode bool, args []string) error {
 		}
 	}()
 
-	if batchMode {
-		return runBatch(conn)
+	if opts.Batch {
+		if opts.JSON {
+			return runBatchJSON(conn, host, opts)
+		}
+		return runBatch(conn, opts)
 	}
 
 	if len(args) == 0 {
 		return fmt.Errorf("no command provided")
 	}
 
-	cmd := strings.Join(args, " ")
-	return runSingle(conn, cmd)
+	req := opts.request(strings.Join(args, " "))
+	if opts.JSON {
+		r := recordCommand(conn, host, req)
+		os.Exit(r.code)
+	}
+	return runSingle(conn, req)
 }
 
-func runSingle(conn net.Conn, cmd string) error {
-	// Send Command
-	if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+// connect returns a ready connection to the daemon serving linkName: its
+// own, or the agent when the configuration enables agent mode.
+func connect(linkName string) (net.Conn, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	identity, host := linkName, ""
+	if cfg.Agent {
+		identity, host = config.AgentIdentity, linkName
+	}
+
+	socketPath := config.ResolveSocketPath(identity)
+	if err := ipc.EnsurePrivateDir(filepath.Dir(socketPath)); err != nil {
+		return nil, fmt.Errorf("refusing to use runtime directory: %w", err)
+	}
+	return connectOrSpawn(socketPath, identity, host)
+}
+
+func runSingle(conn net.Conn, req protocol.Request) error {
+	code, _, err := runCommand(conn, req, writeStdout, writeStderr)
+	if err != nil {
 		return err
 	}
+	os.Exit(code) // Hard exit on single command
+	return nil
+}
 
-	// Handle Response
-	return protocol.DecodeLoop(conn,
-		func(b []byte) {
-			if _, os_err := os.Stdout.Write(b); os_err != nil {
-				fmt.Fprintf(os.Stderr, "Error occurred writing to STDOUT: %v", os_err)
-			}
-		},
-		func(b []byte) {
-			if _, os_err := os.Stderr.Write(b); os_err != nil {
-				fmt.Fprintf(os.Stderr, "Error occurred writing to STDERR: %v", os_err)
-			}
+// runCommand sends one command and relays its output until the daemon
+// reports the exit status. rejection is the daemon's reason when the host's
+// security rules refused the command.
+func runCommand(conn net.Conn, req protocol.Request, onStdout, onStderr func([]byte)) (code int, rejection string, err error) {
+	// Send Command
+	if err := protocol.NewEncoder(conn).EncodeRequest(req); err != nil {
+		return 0, "", err
+	}
+	return awaitExit(conn, onStdout, onStderr)
+}
+
+// awaitExit relays a command's output until the daemon reports its exit
+// status.
+func awaitExit(conn net.Conn, onStdout, onStderr func([]byte)) (code int, rejection string, err error) {
+	exited := false
+	err = protocol.DecodeReply(conn, onStdout, onStderr,
+		func(reason string) { rejection = reason },
+		func(c int) bool {
+			code, exited = c, true
+			return true
 		},
+	)
+	if err == nil && !exited {
+		err = errors.New("daemon closed the connection before the command finished")
+	}
+	return code, rejection, err
+}
+
+// runControl sends a daemon control request and relays the reply.
+func runControl(linkName string, ctl protocol.Control) error {
+	conn, err := connect(linkName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if close_err := conn.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "client close error: %s", close_err)
+		}
+	}()
+
+	if err := protocol.NewEncoder(conn).EncodeJSON(protocol.TypeControl, ctl); err != nil {
+		return err
+	}
+
+	return protocol.DecodeLoop(conn, writeStdout, writeStderr,
 		func(code int) bool {
-			os.Exit(code) // Hard exit on single command
+			os.Exit(code)
 			return true
 		},
 	)
 }
 
-func runBatch(conn net.Conn) error {
+func writeStdout(b []byte) {
+	if _, os_err := os.Stdout.Write(b); os_err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred writing to STDOUT: %v", os_err)
+	}
+}
+
+func writeStderr(b []byte) {
+	if _, os_err := os.Stderr.Write(b); os_err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred writing to STDERR: %v", os_err)
+	}
+}
+
+func runBatch(conn net.Conn, opts Options) error {
 	// Async Sender
 	go func() {
+		encoder := protocol.NewEncoder(conn)
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
 			cmd := strings.TrimSpace(scanner.Text())
 			if cmd == "" {
 				continue
 			}
-			if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+			if err := encoder.EncodeRequest(opts.request(cmd)); err != nil {
 				fmt.Fprintf(os.Stderr, "Error occurred printing to connection: %s", err)
 			}
 		}
@@ -94,17 +232,7 @@ func runBatch(conn net.Conn) error {
 	}()
 
 	// Sync Receiver
-	return protocol.DecodeLoop(conn,
-		func(b []byte) {
-			if _, os_err := os.Stdout.Write(b); os_err != nil {
-				fmt.Fprintf(os.Stderr, "Error occurred writing to STDOUT: %v", os_err)
-			}
-		},
-		func(b []byte) {
-			if _, os_err := os.Stderr.Write(b); os_err != nil {
-				fmt.Fprintf(os.Stderr, "Error occurred writing to STDERR: %v", os_err)
-			}
-		},
+	return protocol.DecodeLoop(conn, writeStdout, writeStderr,
 		func(code int) bool {
 			if code != 0 {
 				fmt.Fprintf(os.Stderr, "[Exit %d]\n", code)
@@ -114,59 +242,106 @@ func runBatch(conn net.Conn) error {
 	)
 }
 
-func connectOrSpawn(socketPath, linkName string) (net.Conn, error) {
+// connectOrSpawn returns a connection to the daemon for identity that is
+// ready to accept commands, starting the daemon first if needed. host names
+// the host to address when the daemon is the agent.
+func connectOrSpawn(socketPath, identity, host string) (net.Conn, error) {
+	conn, err := dial(socketPath, identity)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		err = protocol.NewEncoder(conn).EncodeJSON(protocol.TypeHello, protocol.Hello{Host: host})
+	}
+	if err == nil {
+		err = awaitReady(conn)
+	}
+	if err != nil {
+		if close_err := conn.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "client close error: %s", close_err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// daemonLogPath is where the daemon for identity logs, for error messages.
+func daemonLogPath(identity string) string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "the daemon log"
+	}
+	return config.LogPath(homeDir, identity)
+}
+
+func dial(socketPath, identity string) (net.Conn, error) {
 	conn, err := net.Dial("unix", socketPath)
 	if err == nil {
 		return conn, nil
 	}
 
-	// --- Comprehensive Cleanup ---
-
-	// 1. Clean up based on lock file status (stale or zombie with no socket)
-	lockPath := filepath.Join(filepath.Dir(socketPath), linkName+".lock")
-	ipc.CheckAndCleanLock(lockPath, socketPath)
-
-	// 2. Clean up any remaining zombies that have no lock file.
-	exe, _ := os.Executable()
-	searchPattern := fmt.Sprintf("%s --daemon %s", exe, linkName)
-	// Use pgrep to find processes by full command line.
-	// -f: Interpret pattern as a full extended regular expression
-	pgrepCmd := exec.Command("pgrep", "-f", searchPattern)
-	if output, err := pgrepCmd.Output(); err == nil {
-		pids := strings.Fields(string(output))
-		for _, pidStr := range pids {
-			if pid, convErr := strconv.Atoi(pidStr); convErr == nil {
-				// Don't kill ourselves if pgrep finds the current client process
-				if pid == os.Getpid() {
-					continue
-				}
-				if process, findErr := os.FindProcess(pid); findErr == nil {
-					_ = process.Kill()
-					fmt.Fprintf(os.Stderr, "Killed zombie daemon process with PID %d\n", pid)
-				}
-			}
-		}
-		if len(pids) > 0 {
-			time.Sleep(100 * time.Millisecond) // Wait for killed processes
-		}
+	// No daemon answered: clear out what a previous one left behind
+	lockPath := filepath.Join(filepath.Dir(socketPath), identity+".lock")
+	alive, err := ipc.CheckAndCleanLock(lockPath, socketPath, identity)
+	if err != nil {
+		return nil, err
+	}
+	if alive {
+		return net.Dial("unix", socketPath)
 	}
-
 
 	// --- Spawn New Daemon ---
 
-	cmd := exec.Command(exe, "--daemon", linkName)
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to spawn daemon: %w", err)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to spawn daemon: %w", err)
+	}
+	defer func() {
+		if close_err := readyR.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "pipe close error: %s", close_err)
+		}
+	}()
+
+	// The daemon gets the pipe's write end as fd 3 and writes whether it
+	// started; the read ends at EOF once it has, or has died trying.
+	cmd := exec.Command(exe, "--daemon", identity, "--ready-fd", "3")
+	cmd.ExtraFiles = []*os.File{readyW}
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true} // Detach
-	if err := cmd.Start(); err != nil {
+	err = cmd.Start()
+	if close_err := readyW.Close(); close_err != nil {
+		fmt.Fprintf(os.Stderr, "pipe close error: %s", close_err)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to spawn daemon: %w", err)
 	}
+	go func() {
+		// Reap the daemon if it exits while we're still running
+		_ = cmd.Wait()
+	}()
 
-	// Retry loop
-	for range 20 {
-		time.Sleep(100 * time.Millisecond)
-		conn, err = net.Dial("unix", socketPath)
-		if err == nil {
-			return conn, nil
+	result, err := ipc.ReadStarted(readyR)
+	if err != nil {
+		var startErr *protocol.StartupError
+		if !errors.As(err, &startErr) {
+			return nil, fmt.Errorf("daemon for %s failed to start: %w (see %s)", identity, err, daemonLogPath(identity))
+		}
+		if startErr.Remedy == "" {
+			startErr.Remedy = "See " + daemonLogPath(identity) + " for details."
+		}
+		return nil, startErr
+	}
+	if result == ipc.StartBusy {
+		// Another client's daemon won the lock and is about to listen
+		for range 20 {
+			if conn, err = net.Dial("unix", socketPath); err == nil {
+				return conn, nil
+			}
+			time.Sleep(100 * time.Millisecond)
 		}
 	}
-	return nil, fmt.Errorf("timeout waiting for daemon, check the server logs for full error message")
+	return net.Dial("unix", socketPath)
 }
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// LocalForward asks the daemon to listen locally and forward connections
+// through the master to the remote side, like ssh -L.
+func LocalForward(linkName, spec string) error {
+	return startForward(linkName, protocol.ForwardLocal, spec)
+}
+
+// RemoteForward asks the daemon to listen on the remote host and forward
+// connections back to this machine, like ssh -R.
+func RemoteForward(linkName, spec string) error {
+	return startForward(linkName, protocol.ForwardRemote, spec)
+}
+
+// DynamicForward asks the daemon to run a local SOCKS5 proxy whose
+// connections are made from the remote host, like ssh -D. spec is
+// [bind_address:]port.
+func DynamicForward(linkName, spec string) error {
+	parts := splitSpec(spec)
+
+	bind := "localhost"
+	switch len(parts) {
+	case 1:
+	case 2:
+		bind, parts = parts[0], parts[1:]
+		if bind == "*" {
+			bind = ""
+		}
+	default:
+		return fmt.Errorf("invalid dynamic forward %q, expected [bind_address:]port", spec)
+	}
+	if _, err := strconv.ParseUint(parts[0], 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q in dynamic forward %q", parts[0], spec)
+	}
+
+	fwd := &protocol.Forward{Kind: protocol.ForwardDynamic, Listen: net.JoinHostPort(bind, parts[0])}
+	return runControl(linkName, protocol.Control{Op: protocol.OpForward, Forward: fwd})
+}
+
+// ListForwards prints the daemon's active port forwards.
+func ListForwards(linkName string) error {
+	return runControl(linkName, protocol.Control{Op: protocol.OpListForwards})
+}
+
+// CancelForward stops the port forward with the given ID.
+func CancelForward(linkName string, id int) error {
+	return runControl(linkName, protocol.Control{Op: protocol.OpCancelForward, ID: id})
+}
+
+func startForward(linkName, kind, spec string) error {
+	fwd, err := parseForwardSpec(kind, spec)
+	if err != nil {
+		return err
+	}
+	return runControl(linkName, protocol.Control{Op: protocol.OpForward, Forward: fwd})
+}
+
+// parseForwardSpec parses ssh's [bind_address:]port:host:hostport syntax.
+// Without a bind address the listener is bound to localhost, and "*"
+// binds all interfaces, as with ssh.
+func parseForwardSpec(kind, spec string) (*protocol.Forward, error) {
+	parts := splitSpec(spec)
+
+	bind := "localhost"
+	switch len(parts) {
+	case 3:
+	case 4:
+		bind, parts = parts[0], parts[1:]
+		if bind == "*" {
+			bind = ""
+		}
+	default:
+		return nil, fmt.Errorf("invalid forward %q, expected [bind_address:]port:host:hostport", spec)
+	}
+
+	port, host, hostPort := parts[0], parts[1], parts[2]
+	for _, p := range []string{port, hostPort} {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid port %q in forward %q", p, spec)
+		}
+	}
+
+	return &protocol.Forward{
+		Kind:   kind,
+		Listen: net.JoinHostPort(bind, port),
+		Target: net.JoinHostPort(host, hostPort),
+	}, nil
+}
+
+// splitSpec splits on colons, keeping [bracketed] IPv6 addresses intact.
+func splitSpec(spec string) []string {
+	var (
+		parts   []string
+		current strings.Builder
+		bracket bool
+	)
+	for _, r := range spec {
+		switch {
+		case r == '[':
+			bracket = true
+		case r == ']':
+			bracket = false
+		case r == ':' && !bracket:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(parts, current.String())
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		listen  string
+		target  string
+		wantErr bool
+	}{
+		{spec: "8080:localhost:80", listen: "localhost:8080", target: "localhost:80"},
+		{spec: "127.0.0.1:8080:db:5432", listen: "127.0.0.1:8080", target: "db:5432"},
+		{spec: "*:8080:db:5432", listen: ":8080", target: "db:5432"},
+		{spec: "8080:[::1]:80", listen: "localhost:8080", target: "[::1]:80"},
+		{spec: "[::1]:8080:[2001:db8::1]:443", listen: "[::1]:8080", target: "[2001:db8::1]:443"},
+		{spec: "0:localhost:80", listen: "localhost:0", target: "localhost:80"},
+		{spec: "", wantErr: true},
+		{spec: "8080", wantErr: true},
+		{spec: "8080:localhost", wantErr: true},
+		{spec: "a:b:c:d:e", wantErr: true},
+		{spec: "http:localhost:80", wantErr: true},
+		{spec: "8080:localhost:http", wantErr: true},
+		{spec: "70000:localhost:80", wantErr: true},
+		{spec: "8080:localhost:-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		fwd, err := parseForwardSpec(protocol.ForwardLocal, tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseForwardSpec(%q) = %+v, want error", tt.spec, fwd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseForwardSpec(%q) error: %v", tt.spec, err)
+			continue
+		}
+		if fwd.Kind != protocol.ForwardLocal || fwd.Listen != tt.listen || fwd.Target != tt.target {
+			t.Errorf("parseForwardSpec(%q) = %+v, want listen %q, target %q", tt.spec, fwd, tt.listen, tt.target)
+		}
+	}
+}
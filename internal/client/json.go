@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// commandRecord is the --json output for one command.
+type commandRecord struct {
+	Host            string    `json:"host"`
+	Command         string    `json:"command"`
+	Stdout          string    `json:"stdout"`
+	Stderr          string    `json:"stderr"`
+	ExitCode        int       `json:"exit_code"`
+	Start           time.Time `json:"start,omitzero"`
+	End             time.Time `json:"end,omitzero"`
+	DurationMS      int64     `json:"duration_ms"`
+	PolicyRejection string    `json:"policy_rejection,omitempty"` // Why the daemon refused to run the command
+	Error           string    `json:"error,omitempty"`            // The command could not be run or its result was lost
+	ErrorKind       string    `json:"error_kind,omitempty"`       // Why the host couldn't be used: auth, host_key, network, config or other
+	Remedy          string    `json:"remedy,omitempty"`           // What the user can do about the error
+	Skipped         bool      `json:"skipped,omitempty"`          // Not run because a rollout was halted
+}
+
+// capture collects a command's output for its record.
+type capture struct {
+	stdout, stderr bytes.Buffer
+}
+
+func (c *capture) writeStdout(b []byte) { c.stdout.Write(b) }
+func (c *capture) writeStderr(b []byte) { c.stderr.Write(b) }
+
+// record builds the JSON record for a finished command.
+func (c *capture) record(host, cmd string, r hostResult) commandRecord {
+	rec := commandRecord{
+		Host:            host,
+		Command:         cmd,
+		Stdout:          c.stdout.String(),
+		Stderr:          c.stderr.String(),
+		ExitCode:        r.code,
+		Start:           r.start,
+		End:             r.end,
+		DurationMS:      r.end.Sub(r.start).Milliseconds(),
+		Skipped:         r.skipped,
+		PolicyRejection: r.rejection,
+	}
+	if r.err != nil {
+		rec.Error = r.err.Error()
+		var startErr *protocol.StartupError
+		if errors.As(r.err, &startErr) {
+			rec.Error, rec.ErrorKind, rec.Remedy = startErr.Message, startErr.Kind, startErr.Remedy
+		}
+	}
+	return rec
+}
+
+// jsonOut serializes records from concurrent commands onto stdout, one
+// object per line.
+var jsonOut = struct {
+	sync.Mutex
+	enc *json.Encoder
+}{enc: json.NewEncoder(os.Stdout)}
+
+func printRecord(rec commandRecord) {
+	jsonOut.Lock()
+	defer jsonOut.Unlock()
+	if err := jsonOut.enc.Encode(rec); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred writing JSON output: %v\n", err)
+	}
+}
+
+// recordCommand runs a command on an open daemon connection and prints its
+// record.
+func recordCommand(conn net.Conn, host string, req protocol.Request) hostResult {
+	var out capture
+	r := hostResult{host: host, start: time.Now()}
+	r.code, r.rejection, r.err = runCommand(conn, req, out.writeStdout, out.writeStderr)
+	if r.err != nil {
+		r.code = 255
+	}
+	r.end = time.Now()
+	printRecord(out.record(host, req.Command, r))
+	return r
+}
+
+// recordScript runs a script control request on the host and prints its
+// record. cmd describes the script in the record.
+func recordScript(linkName, cmd string, ctl protocol.Control) hostResult {
+	var out capture
+	r := hostResult{host: linkName, start: time.Now()}
+	conn, err := connect(linkName)
+	if err == nil {
+		if r.err = protocol.NewEncoder(conn).EncodeJSON(protocol.TypeControl, ctl); r.err == nil {
+			r.code, r.rejection, r.err = awaitExit(conn, out.writeStdout, out.writeStderr)
+		}
+		if close_err := conn.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "client close error: %s", close_err)
+		}
+	} else {
+		r.err = err
+	}
+	if r.err != nil {
+		r.code = 255
+	}
+	r.end = time.Now()
+	printRecord(out.record(linkName, cmd, r))
+	return r
+}
+
+// runBatchJSON runs commands from stdin one at a time so each record gets
+// exactly its own output; the daemon's replies carry no command identity.
+func runBatchJSON(conn net.Conn, host string, opts Options) error {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		if r := recordCommand(conn, host, opts.request(cmd)); r.err != nil {
+			return r.err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,238 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// hostResult is the outcome of a command on one host of a multi-host run.
+type hostResult struct {
+	host    string
+	code    int
+	err     error
+	start   time.Time
+	end     time.Time
+	skipped bool // Not run because the rollout was halted
+
+	rejection string // Why the host's security rules refused the command
+}
+
+// RolloutOptions controls how a multi-host run is split into batches.
+type RolloutOptions struct {
+	Serial         int           // Hosts per batch; 0 runs every host at once
+	MaxFailPercent int           // Halt once more than this share of the hosts run so far failed
+	Pause          time.Duration // Wait between batches
+}
+
+// RunHosts runs a command on every host matched by spec, through each
+// host's own daemon, in batches of rollout.Serial hosts. Output lines are
+// prefixed with the host name and a summary table follows on stderr. The
+// exit status is the highest one returned by any host.
+func RunHosts(spec string, args []string, opts Options, rollout RolloutOptions) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command provided")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	hosts, err := cfg.ExpandHosts(spec)
+	if err != nil {
+		return err
+	}
+	cmd := strings.Join(args, " ")
+
+	serial := rollout.Serial
+	if serial <= 0 || serial > len(hosts) {
+		serial = len(hosts)
+	}
+	batches := (len(hosts) + serial - 1) / serial
+
+	var outMu sync.Mutex
+	width := hostWidth(hosts)
+	results := make([]hostResult, len(hosts))
+	failed, halted := 0, false
+
+	for b := range batches {
+		start, end := b*serial, min((b+1)*serial, len(hosts))
+		if halted {
+			for i := start; i < end; i++ {
+				results[i] = hostResult{host: hosts[i], skipped: true}
+				if opts.JSON {
+					var out capture
+					printRecord(out.record(hosts[i], cmd, results[i]))
+				}
+			}
+			continue
+		}
+		if batches > 1 {
+			fmt.Fprintf(os.Stderr, "--- batch %d/%d: %s\n", b+1, batches, strings.Join(hosts[start:end], ", "))
+		}
+
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := withHostEnv(cfg, hosts[i], opts).request(cmd)
+				if opts.JSON {
+					var out capture
+					results[i] = runOnHost(hosts[i], req, out.writeStdout, out.writeStderr)
+					printRecord(out.record(hosts[i], cmd, results[i]))
+					return
+				}
+				stdout := newPrefixWriter(os.Stdout, &outMu, hosts[i], width)
+				stderr := newPrefixWriter(os.Stderr, &outMu, hosts[i], width)
+				results[i] = runOnHost(hosts[i], req, stdout.write, stderr.write)
+				if err := results[i].err; err != nil {
+					stderr.write([]byte(err.Error() + "\n"))
+				}
+				stdout.flush()
+				stderr.flush()
+			}()
+		}
+		wg.Wait()
+
+		for _, r := range results[start:end] {
+			if r.code != 0 {
+				failed++
+			}
+		}
+		if failed*100 > rollout.MaxFailPercent*end {
+			if end < len(hosts) {
+				fmt.Fprintf(os.Stderr, "--- halting: %d of %d hosts failed (limit %d%%)\n", failed, end, rollout.MaxFailPercent)
+			}
+			halted = true
+			continue
+		}
+		if rollout.Pause > 0 && end < len(hosts) {
+			time.Sleep(rollout.Pause)
+		}
+	}
+
+	printSummary(results)
+	if code := worstExit(results); code != 0 {
+		os.Exit(code)
+	}
+	return nil
+}
+
+// runOnHost runs a command through the host's daemon, spawning it if needed.
+func runOnHost(host string, req protocol.Request, onStdout, onStderr func([]byte)) hostResult {
+	result := hostResult{host: host, start: time.Now()}
+
+	conn, err := connect(host)
+	if err != nil {
+		result.end = time.Now()
+		result.code, result.err = 255, err
+		return result
+	}
+	defer func() {
+		if close_err := conn.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "client close error: %s", close_err)
+		}
+	}()
+
+	result.code, result.rejection, result.err = runCommand(conn, req, onStdout, onStderr)
+	if result.err != nil {
+		result.code = 255
+	}
+	result.end = time.Now()
+	return result
+}
+
+// prefixWriter writes whole lines prefixed with a host name, so output from
+// several hosts never mixes within a line.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, mu *sync.Mutex, host string, width int) *prefixWriter {
+	return &prefixWriter{w: w, mu: mu, prefix: fmt.Sprintf("%-*s | ", width, host)}
+}
+
+func (p *prefixWriter) write(b []byte) {
+	p.buf = append(p.buf, b...)
+	end := bytes.LastIndexByte(p.buf, '\n')
+	if end < 0 {
+		return
+	}
+	p.emit(p.buf[:end+1])
+	p.buf = append(p.buf[:0], p.buf[end+1:]...)
+}
+
+// flush writes any unterminated last line.
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		p.emit(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) emit(lines []byte) {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			out.WriteString(p.prefix)
+			out.Write(line)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(out.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred writing output: %v\n", err)
+	}
+}
+
+func hostWidth(hosts []string) int {
+	width := 0
+	for _, host := range hosts {
+		width = max(width, len(host))
+	}
+	return width
+}
+
+func printSummary(results []hostResult) {
+	tw := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nHOST\tTIME\tSTATUS")
+	for _, r := range results {
+		status, took := "ok", r.end.Sub(r.start).Round(time.Millisecond).String()
+		switch {
+		case r.skipped:
+			status, took = "skipped", "-"
+		case r.err != nil:
+			status = "error: " + firstLine(r.err.Error())
+		case r.code != 0:
+			status = fmt.Sprintf("exit %d", r.code)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.host, took, status)
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred writing summary: %v\n", err)
+	}
+}
+
+func worstExit(results []hostResult) int {
+	code := 0
+	for _, r := range results {
+		code = max(code, r.code)
+	}
+	return code
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ktoks/remote/internal/protocol"
+
+	"golang.org/x/term"
+)
+
+// awaitReady waits for the daemon's greeting, answering any prompts it
+// raises while the master connection is being established.
+func awaitReady(conn net.Conn) error {
+	encoder := protocol.NewEncoder(conn)
+	var (
+		startupErr strings.Builder
+		structured *protocol.StartupError
+	)
+
+	for {
+		pkt, err := protocol.ReadPacket(conn)
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("daemon closed the connection before it was ready")
+			}
+			return err
+		}
+
+		switch pkt.Type {
+		case protocol.TypeReady:
+			return nil
+		case protocol.TypePrompt:
+			var prompt protocol.Prompt
+			if err := json.Unmarshal(pkt.Data, &prompt); err != nil {
+				return fmt.Errorf("invalid prompt from daemon: %w", err)
+			}
+			reply := protocol.Reply{Answers: askUser(prompt)}
+			if err := encoder.EncodeJSON(protocol.TypeReply, reply); err != nil {
+				return err
+			}
+		case protocol.TypeStartupError:
+			structured = &protocol.StartupError{}
+			if err := json.Unmarshal(pkt.Data, structured); err != nil {
+				return fmt.Errorf("invalid startup error from daemon: %w", err)
+			}
+		case protocol.TypeStderr:
+			startupErr.Write(pkt.Data)
+		case protocol.TypeExit:
+			if structured != nil {
+				return structured
+			}
+			if startupErr.Len() > 0 {
+				return errors.New(strings.TrimSpace(startupErr.String()))
+			}
+			return fmt.Errorf("daemon failed to start (exit %d)", pkt.Code)
+		}
+	}
+}
+
+// ttyMu keeps prompts from daemons started in parallel from interleaving.
+var ttyMu sync.Mutex
+
+// askUser reads answers from the controlling terminal, since stdin may be
+// carrying batch commands. It returns nil if there is no terminal to ask.
+func askUser(prompt protocol.Prompt) []string {
+	ttyMu.Lock()
+	defer ttyMu.Unlock()
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot prompt for input: %v\n", err)
+		return nil
+	}
+	defer func() {
+		if close_err := tty.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "tty close error: %s", close_err)
+		}
+	}()
+
+	if prompt.Instruction != "" {
+		fmt.Fprintln(tty, prompt.Instruction)
+	}
+
+	reader := bufio.NewReader(tty)
+	answers := make([]string, 0, len(prompt.Questions))
+	for _, question := range prompt.Questions {
+		fmt.Fprint(tty, question.Text)
+
+		if !question.Echo {
+			secret, err := term.ReadPassword(int(tty.Fd()))
+			fmt.Fprintln(tty)
+			if err != nil {
+				return nil
+			}
+			answers = append(answers, string(secret))
+			continue
+		}
+
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil
+		}
+		answers = append(answers, strings.TrimRight(line, "\r\n"))
+	}
+	return answers
+}
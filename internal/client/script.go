@@ -0,0 +1,47 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// RunScript runs a local script on the host without copying it there. The
+// script is checked against the host's policy before anything is sent; the
+// daemon repeats the check before running it. The options apply as they do
+// to a command.
+func RunScript(linkName, scriptPath string, args []string, opts Options) error {
+	body, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	opts = withHostEnv(cfg, linkName, opts)
+	cmd := strings.Join(append([]string{scriptPath}, args...), " ")
+	if _, err := cfg.GetHostConfig(linkName).ValidateShellScript(string(body)); err != nil {
+		if opts.JSON {
+			now := time.Now()
+			printRecord(commandRecord{Host: linkName, Command: cmd, ExitCode: 1, Start: now, End: now, PolicyRejection: err.Error()})
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Security violation: %s: %v\n", scriptPath, err)
+		os.Exit(1)
+	}
+
+	script := &protocol.Script{Body: string(body), Args: args, Options: opts.request("").Options}
+	ctl := protocol.Control{
+		Op:     protocol.OpScript,
+		Script: script,
+	}
+	if opts.JSON {
+		os.Exit(recordScript(linkName, cmd, ctl).code)
+	}
+	return runControl(linkName, ctl)
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// SyncOptions controls how Sync compares and updates the remote tree.
+type SyncOptions struct {
+	Delete   bool // Remove remote files that don't exist locally
+	Checksum bool // Compare contents instead of size and modification time
+	DryRun   bool // Only print what would change
+}
+
+// Sync makes remoteDir on the host mirror localDir. Only files the daemon
+// reports as changed are sent.
+func Sync(linkName, localDir, remoteDir string, opts SyncOptions) error {
+	entries, err := syncManifest(localDir, opts.Checksum)
+	if err != nil {
+		return err
+	}
+
+	conn, err := connect(linkName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if close_err := conn.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "client close error: %s", close_err)
+		}
+	}()
+
+	encoder := protocol.NewEncoder(conn)
+	ctl := protocol.Control{Op: protocol.OpSync, Sync: &protocol.SyncRequest{
+		Path:     remoteDir,
+		Delete:   opts.Delete,
+		Checksum: opts.Checksum,
+		DryRun:   opts.DryRun,
+		Entries:  entries,
+	}}
+	if err := encoder.EncodeJSON(protocol.TypeControl, ctl); err != nil {
+		return err
+	}
+
+	var bar *progress
+	sent := make(chan struct{})
+	for {
+		pkt, err := protocol.ReadPacket(conn)
+		if err != nil {
+			return transferReadError(err)
+		}
+
+		switch pkt.Type {
+		case protocol.TypeSyncPlan:
+			var plan protocol.SyncPlan
+			if err := json.Unmarshal(pkt.Data, &plan); err != nil {
+				return fmt.Errorf("invalid sync plan from daemon: %w", err)
+			}
+			if opts.DryRun {
+				printPlan(&plan)
+				continue
+			}
+			bar = newProgress(filepath.Base(localDir), planSize(entries, plan.Send))
+			go func() {
+				defer close(sent)
+				sendTree(encoder, localDir, plan.Send, bar)
+			}()
+		case protocol.TypeStdout:
+			writeStdout(pkt.Data)
+		case protocol.TypeStderr:
+			writeStderr(pkt.Data)
+		case protocol.TypeExit:
+			if bar != nil {
+				<-sent
+				bar.finish()
+			}
+			if pkt.Code != 0 {
+				os.Exit(int(pkt.Code))
+			}
+			return nil
+		}
+	}
+}
+
+// syncManifest lists localDir as slash paths relative to it. Symlinks are
+// skipped since SFTP would copy their targets rather than the links.
+func syncManifest(localDir string, checksum bool) ([]protocol.SyncEntry, error) {
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", localDir)
+	}
+
+	var entries []protocol.SyncEntry
+	err = filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			fmt.Fprintf(os.Stderr, "Skipping symlink %s\n", p)
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			fmt.Fprintf(os.Stderr, "Skipping special file %s\n", p)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := protocol.SyncEntry{
+			Path:    filepath.ToSlash(rel),
+			Dir:     d.IsDir(),
+			ModTime: info.ModTime().Unix(),
+			Mode:    uint32(info.Mode().Perm()),
+		}
+		if !e.Dir {
+			e.Size = info.Size()
+			if checksum {
+				if e.SHA256, err = fileChecksum(p); err != nil {
+					return err
+				}
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if close_err := f.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "file close error: %s", close_err)
+		}
+	}()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// sendTree streams each planned file in order. A file that can't be read
+// is still terminated so the daemon stays in step and skips it.
+func sendTree(enc *protocol.Encoder, localDir string, files []string, bar *progress) {
+	var total int64
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(localDir, filepath.FromSlash(rel)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred reading file: %v\n", err)
+			if enc_err := enc.Encode(protocol.TypeDataEnd, nil); enc_err != nil {
+				fmt.Fprintf(os.Stderr, "Error occurred sending file data: %v\n", enc_err)
+				return
+			}
+			continue
+		}
+
+		counted := &countingReader{r: f, onRead: func(n int) {
+			total += int64(n)
+			bar.update(total)
+		}}
+		sendFile(enc, counted)
+		if close_err := f.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "file close error: %s", close_err)
+		}
+	}
+}
+
+// countingReader reports each read so progress can span several files.
+type countingReader struct {
+	r      io.Reader
+	onRead func(int)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.onRead(n)
+	return n, err
+}
+
+func planSize(entries []protocol.SyncEntry, files []string) int64 {
+	sizes := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		sizes[e.Path] = e.Size
+	}
+	var total int64
+	for _, rel := range files {
+		total += sizes[rel]
+	}
+	return total
+}
+
+func printPlan(plan *protocol.SyncPlan) {
+	for _, dir := range plan.Mkdir {
+		fmt.Printf("mkdir  %s/\n", dir)
+	}
+	for _, file := range plan.Send {
+		fmt.Printf("send   %s\n", file)
+	}
+	for _, p := range plan.Delete {
+		fmt.Printf("delete %s\n", p)
+	}
+	if len(plan.Mkdir)+len(plan.Send)+len(plan.Delete) == 0 {
+		fmt.Println("Up to date")
+	}
+}
@@ -0,0 +1,344 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/ktoks/remote/internal/protocol"
+
+	"golang.org/x/term"
+)
+
+// transferChunk is the size of data packets sent to the daemon.
+const transferChunk = 32 * 1024
+
+// Push uploads a local file to remotePath on the host. If remotePath is a
+// directory the file keeps its name.
+func Push(linkName, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if close_err := f.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "file close error: %s", close_err)
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", localPath)
+	}
+
+	conn, err := connect(linkName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if close_err := conn.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "client close error: %s", close_err)
+		}
+	}()
+
+	encoder := protocol.NewEncoder(conn)
+	ctl := protocol.Control{Op: protocol.OpPush, Transfer: &protocol.Transfer{
+		Path: remotePath,
+		Name: filepath.Base(localPath),
+		Size: info.Size(),
+		Mode: uint32(info.Mode().Perm()),
+	}}
+	if err := encoder.EncodeJSON(protocol.TypeControl, ctl); err != nil {
+		return err
+	}
+
+	bar := newProgress(filepath.Base(localPath), info.Size())
+	started := false
+	for {
+		pkt, err := protocol.ReadPacket(conn)
+		if err != nil {
+			return transferReadError(err)
+		}
+
+		switch pkt.Type {
+		case protocol.TypeProgress:
+			// The first report is the daemon's go-ahead
+			if !started {
+				started = true
+				go sendFile(encoder, f)
+			}
+			bar.update(int64(binary.BigEndian.Uint64(pkt.Data)))
+		case protocol.TypeStdout:
+			bar.finish()
+			writeStdout(pkt.Data)
+		case protocol.TypeStderr:
+			bar.finish()
+			writeStderr(pkt.Data)
+		case protocol.TypeExit:
+			bar.finish()
+			if pkt.Code != 0 {
+				os.Exit(int(pkt.Code))
+			}
+			return nil
+		}
+	}
+}
+
+// sendFile streams r to the daemon followed by its checksum. A read error
+// is signalled with an empty checksum so the daemon discards the upload.
+func sendFile(enc *protocol.Encoder, r io.Reader) {
+	sum := sha256.New()
+	buf := make([]byte, transferChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			if enc_err := enc.Encode(protocol.TypeData, buf[:n]); enc_err != nil {
+				fmt.Fprintf(os.Stderr, "Error occurred sending file data: %v\n", enc_err)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred reading file: %v\n", err)
+			if enc_err := enc.Encode(protocol.TypeDataEnd, nil); enc_err != nil {
+				fmt.Fprintf(os.Stderr, "Error occurred sending file data: %v\n", enc_err)
+			}
+			return
+		}
+	}
+
+	if err := enc.Encode(protocol.TypeDataEnd, []byte(hex.EncodeToString(sum.Sum(nil)))); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred sending file data: %v\n", err)
+	}
+}
+
+// Pull downloads remotePath from the host. localPath defaults to the
+// remote file name in the current directory; an existing directory
+// receives the file under its remote name.
+func Pull(linkName, remotePath, localPath string) error {
+	conn, err := connect(linkName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if close_err := conn.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "client close error: %s", close_err)
+		}
+	}()
+
+	ctl := protocol.Control{Op: protocol.OpPull, Transfer: &protocol.Transfer{Path: remotePath}}
+	if err := protocol.NewEncoder(conn).EncodeJSON(protocol.TypeControl, ctl); err != nil {
+		return err
+	}
+
+	var d *download
+	defer func() {
+		if d != nil {
+			d.abort()
+		}
+	}()
+
+	for {
+		pkt, err := protocol.ReadPacket(conn)
+		if err != nil {
+			return transferReadError(err)
+		}
+
+		switch pkt.Type {
+		case protocol.TypeFileInfo:
+			var meta protocol.Transfer
+			if err := json.Unmarshal(pkt.Data, &meta); err != nil {
+				return fmt.Errorf("invalid file info from daemon: %w", err)
+			}
+			if d, err = newDownload(meta, localPath); err != nil {
+				return err
+			}
+		case protocol.TypeData:
+			if d == nil {
+				return errors.New("file data before file info")
+			}
+			if err := d.write(pkt.Data); err != nil {
+				return err
+			}
+		case protocol.TypeDataEnd:
+			if d == nil {
+				return errors.New("end of file before file info")
+			}
+			if err := d.commit(string(pkt.Data)); err != nil {
+				return err
+			}
+		case protocol.TypeStdout:
+			writeStdout(pkt.Data)
+		case protocol.TypeStderr:
+			if d != nil {
+				d.bar.finish()
+			}
+			writeStderr(pkt.Data)
+		case protocol.TypeExit:
+			if pkt.Code != 0 {
+				if d != nil {
+					d.abort()
+				}
+				os.Exit(int(pkt.Code))
+			}
+			return nil
+		}
+	}
+}
+
+// download writes an incoming file next to its destination and renames it
+// into place once the checksum matches.
+type download struct {
+	dest     string
+	mode     os.FileMode
+	file     *os.File
+	sum      hash.Hash
+	received int64
+	bar      *progress
+	done     bool
+}
+
+func newDownload(meta protocol.Transfer, localPath string) (*download, error) {
+	name := path.Base(meta.Path)
+	dest := localPath
+	if dest == "" {
+		dest = name
+	} else if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, name)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".part-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &download{
+		dest: dest,
+		mode: os.FileMode(meta.Mode).Perm(),
+		file: file,
+		sum:  sha256.New(),
+		bar:  newProgress(name, meta.Size),
+	}, nil
+}
+
+func (d *download) write(data []byte) error {
+	if _, err := d.file.Write(data); err != nil {
+		return err
+	}
+	d.sum.Write(data)
+	d.received += int64(len(data))
+	d.bar.update(d.received)
+	return nil
+}
+
+func (d *download) commit(want string) error {
+	d.bar.finish()
+
+	got := hex.EncodeToString(d.sum.Sum(nil))
+	if got != want {
+		return fmt.Errorf("checksum mismatch: daemon sent %s, received %s", want, got)
+	}
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	if d.mode != 0 {
+		if err := os.Chmod(d.file.Name(), d.mode); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(d.file.Name(), d.dest); err != nil {
+		return err
+	}
+	d.done = true
+
+	fmt.Printf("%s: %d bytes, sha256 %s\n", d.dest, d.received, got)
+	return nil
+}
+
+// abort removes the partial file unless the download was committed.
+func (d *download) abort() {
+	if d.done {
+		return
+	}
+	d.done = true
+	_ = d.file.Close()
+	if os_err := os.Remove(d.file.Name()); os_err != nil && !os.IsNotExist(os_err) {
+		fmt.Fprintf(os.Stderr, "Error occurred removing partial download: %v\n", os_err)
+	}
+}
+
+func transferReadError(err error) error {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return errors.New("daemon closed the connection during transfer")
+	}
+	return err
+}
+
+// progress draws a one-line transfer indicator on stderr when it is a terminal.
+type progress struct {
+	name    string
+	total   int64
+	current int64
+	enabled bool
+	drawn   time.Time
+}
+
+func newProgress(name string, total int64) *progress {
+	return &progress{name: name, total: total, enabled: term.IsTerminal(int(os.Stderr.Fd()))}
+}
+
+func (p *progress) update(n int64) {
+	p.current = n
+	if !p.enabled || time.Since(p.drawn) < 100*time.Millisecond {
+		return
+	}
+	p.draw()
+}
+
+// finish draws the final state and ends the line. Further calls are no-ops.
+func (p *progress) finish() {
+	if !p.enabled {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(os.Stderr)
+	p.enabled = false
+}
+
+func (p *progress) draw() {
+	percent := 100
+	if p.total > 0 {
+		percent = int(p.current * 100 / p.total)
+	}
+	fmt.Fprintf(os.Stderr, "\r%s %3d%% %s / %s", p.name, percent, formatBytes(p.current), formatBytes(p.total))
+	p.drawn = time.Now()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
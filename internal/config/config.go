@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -18,10 +20,14 @@ import (
 var defaultConfigFile []byte
 
 const (
-	// SocketSubDir - where unix sockets will reside
-	SocketSubDir = ".ssh/sockets"
+	// AppDir - subdirectory of the runtime and state directories used by remote
+	AppDir = "remote"
+	// AgentIdentity - socket, lock and log name of the daemon serving every host in agent mode
+	AgentIdentity = "remote-agent"
 	// IdleTimeout - how long the master will exist
 	IdleTimeout = 5 * time.Minute
+	// DefaultMaxSessions - sessions open at once per connection, OpenSSH's MaxSessions default
+	DefaultMaxSessions = 10
 )
 
 // HostConfig defines settings for a specific host
@@ -30,9 +36,35 @@ type HostConfig struct {
 	Port            string              `json:"port"`
 	User            string              `json:"user"`
 	IgnoreHostKey   bool                `json:"ignore_host_key"`
+	TrustOnFirstUse bool                `json:"trust_on_first_use"` // Ask the client to accept unknown host keys
+	CertAuthorities []string            `json:"cert_authorities"`   // CA public keys (authorized_keys format) trusted to sign host certificates
+	ForwardAgent    bool                `json:"forward_agent"`      // Forward the local SSH agent to remote commands
+	Timeout         Duration            `json:"timeout"`            // Longest a command may run, e.g. "10m"; 0 means no limit
+	SendEnv         []string            `json:"send_env"`           // Local environment variables (or patterns like LC_*) sent with each command
+	DefaultDir      string              `json:"default_dir"`        // Directory commands run in unless the client asks for another
+	AllowedClients  []string            `json:"allowed_clients"`    // Local executables allowed to use the daemon's socket; any when empty
+	MaxSessions     int                 `json:"max_sessions"`       // Sessions open at once per connection; match the server's MaxSessions
+	MaxConnections  int                 `json:"max_connections"`    // Connections to open when sessions are queued; 1 queues them instead
 	AllowedCommands []string            `json:"allowed_commands"`
 	Constraints     []CommandConstraint `json:"constraints"`
 	Security        *SecurityRules      `json:"security"`
+	Audit           *AuditConfig        `json:"audit"`
+	Limits          *CommandLimits      `json:"limits"`
+}
+
+// CommandLimits cap the commands a daemon runs on the host across all of
+// its clients. Zero means no limit.
+type CommandLimits struct {
+	MaxConcurrent int  `json:"max_concurrent"` // Commands running at once
+	PerMinute     int  `json:"per_minute"`     // Commands started in any minute
+	Queue         bool `json:"queue"`          // Wait for capacity instead of refusing the command
+}
+
+// AuditConfig controls the daemon's record of every request it handles.
+type AuditConfig struct {
+	Disabled bool   `json:"disabled"`
+	Path     string `json:"path"`   // Defaults to AuditLogPath
+	Syslog   bool   `json:"syslog"` // Also send entries to the local syslog (and so journald)
 }
 
 // SecurityRules defines global or per-host shell feature restrictions
@@ -40,6 +72,21 @@ type SecurityRules struct {
 	AllowPipes     bool `json:"allow_pipes"`
 	AllowRedirects bool `json:"allow_redirects"`
 	AllowChaining  bool `json:"allow_chaining"` // Allow ;, &&, ||
+	// AllowForwarding permits port forwards over the master connection,
+	// which are not subject to command validation.
+	AllowForwarding bool `json:"allow_forwarding"`
+	// AllowedPaths are remote directories files may be pushed to or pulled
+	// from. Transfers are disabled when empty.
+	AllowedPaths []string `json:"allowed_paths"`
+	// AgentCommands limits agent forwarding to commands made up only of
+	// these programs (e.g. git). Empty means every allowed command.
+	AgentCommands []string `json:"agent_commands"`
+	// AllowedEnv lists the environment variable names (or patterns like
+	// LC_*) clients may set for remote commands. None may be set when empty.
+	AllowedEnv []string `json:"allowed_env"`
+	// AllowedDirs are the directories (and their subdirectories) clients may
+	// ask commands to run in. Choosing a directory is disabled when empty.
+	AllowedDirs []string `json:"allowed_dirs"`
 }
 
 // CommandConstraint defines specific restrictions for an allowed command
@@ -47,51 +94,264 @@ type CommandConstraint struct {
 	Command   string   `json:"command"`
 	AllowArgs []string `json:"allow_args"` // Regex-like patterns (currently simple prefix)
 	DenyArgs  []string `json:"deny_args"`
+	Timeout   Duration `json:"timeout"` // Overrides the host timeout when shorter
+}
+
+// Duration is a time.Duration read from JSON as a string such as "90s" or
+// "5m", or as a number of seconds.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", v, err)
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
 }
 
 // IsCommandAllowed checks if a command is in the list of allowed commands
 func (c *HostConfig) IsCommandAllowed(command string) bool {
+	return c.commandRule(command) != ""
+}
+
+// commandRule names the entry that allows a command, such as
+// "constraints: cat" or "allowed_commands: ls", or "" if none does.
+func (c *HostConfig) commandRule(command string) string {
 	// 1. Check explicitly listed constraints first
 	for _, constraint := range c.Constraints {
 		if command == constraint.Command {
-			return true
+			return "constraints: " + command
 		}
 	}
 
 	// 2. Check simple allowed list
 	for _, allowed := range c.AllowedCommands {
 		if command == allowed {
+			return "allowed_commands: " + command
+		}
+	}
+	return ""
+}
+
+// Rules returns the host's security rules, defaulting to strict rules if
+// none are configured.
+func (c *HostConfig) Rules() *SecurityRules {
+	if c.Security == nil {
+		return &SecurityRules{
+			AllowPipes:     false,
+			AllowRedirects: false,
+			AllowChaining:  false,
+		}
+	}
+	return c.Security
+}
+
+// IsPathAllowed reports whether a remote path lies within one of the
+// allowed transfer directories. The path must already be absolute and
+// resolved (no symlinks) for the check to be meaningful.
+func (c *HostConfig) IsPathAllowed(remotePath string) bool {
+	return withinAny(remotePath, c.Rules().AllowedPaths)
+}
+
+// IsDirAllowed reports whether a client may run commands in dir. The
+// directory must be absolute.
+func (c *HostConfig) IsDirAllowed(dir string) bool {
+	return withinAny(dir, c.Rules().AllowedDirs)
+}
+
+// withinAny reports whether the absolute path p is one of dirs or lies below
+// one of them.
+func withinAny(p string, dirs []string) bool {
+	if !path.IsAbs(p) {
+		return false
+	}
+	cleaned := path.Clean(p)
+	for _, allowed := range dirs {
+		allowed = path.Clean(allowed)
+		if cleaned == allowed || strings.HasPrefix(cleaned, strings.TrimSuffix(allowed, "/")+"/") {
 			return true
 		}
 	}
 	return false
 }
 
-// ValidateShellCommand parses and validates a shell string using mvdan/sh
-func (c *HostConfig) ValidateShellCommand(cmdStr string) error {
-	p := syntax.NewParser()
-	f, err := p.Parse(strings.NewReader(cmdStr), "")
+// IsAgentForwardingAllowed reports whether the SSH agent may be forwarded
+// to the session running cmdStr.
+func (c *HostConfig) IsAgentForwardingAllowed(cmdStr string) bool {
+	if !c.ForwardAgent {
+		return false
+	}
+	agentCommands := c.Rules().AgentCommands
+	if len(agentCommands) == 0 {
+		return true
+	}
+
+	names, err := CommandNames(cmdStr)
+	if err != nil || len(names) == 0 {
+		return false
+	}
+	for _, name := range names {
+		if !slices.Contains(agentCommands, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsEnvAllowed reports whether clients may set the named environment
+// variable for remote commands.
+func (c *HostConfig) IsEnvAllowed(name string) bool {
+	return MatchEnv(c.Rules().AllowedEnv, name)
+}
+
+// SessionLimit is how many sessions may be open at once on each connection
+// to the host.
+func (c *HostConfig) SessionLimit() int {
+	if c.MaxSessions > 0 {
+		return c.MaxSessions
+	}
+	return DefaultMaxSessions
+}
+
+// ConnectionLimit is how many connections to the host the daemon may open.
+func (c *HostConfig) ConnectionLimit() int {
+	return max(c.MaxConnections, 1)
+}
+
+// IsClientAllowed reports whether a local process running the executable
+// at exe may use the host's daemon.
+func (c *HostConfig) IsClientAllowed(exe string) bool {
+	if len(c.AllowedClients) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedClients {
+		if filepath.Clean(allowed) == exe {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchEnv reports whether an environment variable name matches any of the
+// patterns.
+func MatchEnv(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandTimeout returns the longest cmdStr may run on this host: the
+// shortest of the host timeout and the timeouts of any constrained command
+// it invokes. Zero means no limit.
+func (c *HostConfig) CommandTimeout(cmdStr string) time.Duration {
+	timeout := time.Duration(c.Timeout)
+	names, err := CommandNames(cmdStr)
 	if err != nil {
-		return fmt.Errorf("invalid shell syntax: %w", err)
+		return timeout
+	}
+	for _, constraint := range c.Constraints {
+		limit := time.Duration(constraint.Timeout)
+		if limit > 0 && slices.Contains(names, constraint.Command) {
+			timeout = ShorterTimeout(timeout, limit)
+		}
 	}
+	return timeout
+}
 
-	sec := c.Security
-	if sec == nil {
-		// Default strict security if not specified
-		sec = &SecurityRules{
-			AllowPipes:     false,
-			AllowRedirects: false,
-			AllowChaining:  false,
+// ShorterTimeout returns the stricter of two timeouts, where zero means no
+// limit.
+func ShorterTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// CommandNames returns the literal program names invoked by a shell string.
+func CommandNames(cmdStr string) ([]string, error) {
+	f, err := syntax.NewParser().Parse(strings.NewReader(cmdStr), "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid shell syntax: %w", err)
+	}
+
+	var names []string
+	syntax.Walk(f, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok && len(call.Args) > 0 && len(call.Args[0].Parts) > 0 {
+			if lit, ok := call.Args[0].Parts[0].(*syntax.Lit); ok {
+				names = append(names, lit.Value)
+			}
 		}
+		return true
+	})
+	return names, nil
+}
+
+// ValidateShellCommand parses and validates a shell string using mvdan/sh.
+// It returns the entries that allowed the commands the string runs.
+func (c *HostConfig) ValidateShellCommand(cmdStr string) ([]string, error) {
+	p := syntax.NewParser()
+	f, err := p.Parse(strings.NewReader(cmdStr), "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid shell syntax: %w", err)
 	}
 
 	// Check for multiple statements (semicolon or newline chaining)
-	if !sec.AllowChaining && len(f.Stmts) > 1 {
-		return fmt.Errorf("multiple commands (;) are disabled")
+	if !c.Rules().AllowChaining && len(f.Stmts) > 1 {
+		return nil, fmt.Errorf("multiple commands (;) are disabled")
+	}
+
+	return c.validateNode(f)
+}
+
+// ValidateShellScript validates a multi-line script. Each top-level
+// statement is checked as if it were sent on its own, so the script may have
+// several lines but every line is held to the same rules as a command.
+func (c *HostConfig) ValidateShellScript(script string) ([]string, error) {
+	f, err := syntax.NewParser().Parse(strings.NewReader(script), "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid shell syntax: %w", err)
 	}
 
+	var rules []string
+	for _, stmt := range f.Stmts {
+		matched, err := c.validateNode(stmt)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", stmt.Pos().Line(), err)
+		}
+		for _, rule := range matched {
+			if !slices.Contains(rules, rule) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// validateNode walks a parsed command checking shell features, command
+// names and argument constraints against the host's rules, and returns the
+// entries that allowed each command, once each.
+func (c *HostConfig) validateNode(root syntax.Node) ([]string, error) {
+	sec := c.Rules()
+
+	var rules []string
 	var validationErr error
-	syntax.Walk(f, func(node syntax.Node) bool {
+	syntax.Walk(root, func(node syntax.Node) bool {
 		switch n := node.(type) {
 		case *syntax.BinaryCmd:
 			// Op can be syntax.AndStmt (&&), syntax.OrStmt (||), syntax.Pipe (|)
@@ -129,10 +389,14 @@ func (c *HostConfig) ValidateShellCommand(cmdStr string) error {
 			}
 
 			cmdName := lit.Value
-			if !c.IsCommandAllowed(cmdName) {
+			rule := c.commandRule(cmdName)
+			if rule == "" {
 				validationErr = fmt.Errorf("command not allowed: %s", cmdName)
 				return false
 			}
+			if !slices.Contains(rules, rule) {
+				rules = append(rules, rule)
+			}
 
 			// Check constraints if any
 			for _, constraint := range c.Constraints {
@@ -174,18 +438,89 @@ func (c *HostConfig) ValidateShellCommand(cmdStr string) error {
 		return true
 	})
 
-	return validationErr
+	if validationErr != nil {
+		return nil, validationErr
+	}
+	return rules, nil
 }
 
 // Config holds the application configuration
 type Config struct {
 	Hosts    map[string]HostConfig `json:"hosts"`
 	Defaults HostConfig            `json:"defaults"`
+	Groups   map[string][]string   `json:"groups"` // Named host lists for multi-host runs
+	Agent    bool                  `json:"agent"`  // Serve every host from one daemon instead of one daemon per host
 }
 
-// GetHostConfig returns the configuration for a specific host, falling back
-// to defaults for any unset values.
-func (c *Config) GetHostConfig(host string) *HostConfig {
+// ExpandHosts turns a comma-separated host list into host names. Entries may
+// be group names, glob patterns matched against the configured hosts (e.g.
+// "db*"), or plain host names.
+func (c *Config) ExpandHosts(spec string) ([]string, error) {
+	var hosts []string
+	seen := make(map[string]bool)
+	add := func(host string) {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	configured := make([]string, 0, len(c.Hosts))
+	for name := range c.Hosts {
+		configured = append(configured, name)
+	}
+	slices.Sort(configured)
+
+	var expand func(entry string, inGroup bool) error
+	expand = func(entry string, inGroup bool) error {
+		if members, ok := c.Groups[entry]; ok && !inGroup {
+			for _, member := range members {
+				if err := expand(member, true); err != nil {
+					return fmt.Errorf("group %s: %w", entry, err)
+				}
+			}
+			return nil
+		}
+		if !strings.ContainsAny(entry, "*?[") {
+			add(entry)
+			return nil
+		}
+
+		matched := false
+		for _, name := range configured {
+			ok, err := path.Match(entry, name)
+			if err != nil {
+				return fmt.Errorf("invalid host pattern %q: %w", entry, err)
+			}
+			if ok {
+				matched = true
+				add(name)
+			}
+		}
+		if !matched {
+			return fmt.Errorf("no configured hosts match %q", entry)
+		}
+		return nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := expand(entry, false); err != nil {
+			return nil, err
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts given")
+	}
+	return hosts, nil
+}
+
+// MergedHostConfig returns the configuration for a specific host, falling
+// back to defaults for any unset values. Unlike GetHostConfig it ignores the
+// environment, which the agent shares between every host.
+func (c *Config) MergedHostConfig(host string) *HostConfig {
 	hostCfg, ok := c.Hosts[host]
 	if !ok {
 		// No specific config for this host, return defaults but set address to host if default address is empty
@@ -223,9 +558,52 @@ func (c *Config) GetHostConfig(host string) *HostConfig {
 	if !newCfg.IgnoreHostKey {
 		newCfg.IgnoreHostKey = c.Defaults.IgnoreHostKey
 	}
+	if !newCfg.TrustOnFirstUse {
+		newCfg.TrustOnFirstUse = c.Defaults.TrustOnFirstUse
+	}
+	if !newCfg.ForwardAgent {
+		newCfg.ForwardAgent = c.Defaults.ForwardAgent
+	}
+	if newCfg.Timeout == 0 {
+		newCfg.Timeout = c.Defaults.Timeout
+	}
+	if newCfg.MaxSessions == 0 {
+		newCfg.MaxSessions = c.Defaults.MaxSessions
+	}
+	if newCfg.MaxConnections == 0 {
+		newCfg.MaxConnections = c.Defaults.MaxConnections
+	}
+	if newCfg.Audit == nil {
+		newCfg.Audit = c.Defaults.Audit
+	}
+	if newCfg.Limits == nil {
+		newCfg.Limits = c.Defaults.Limits
+	}
+	if newCfg.DefaultDir == "" {
+		newCfg.DefaultDir = c.Defaults.DefaultDir
+	}
+	if len(newCfg.SendEnv) == 0 {
+		newCfg.SendEnv = c.Defaults.SendEnv
+	}
+	if len(newCfg.CertAuthorities) == 0 {
+		newCfg.CertAuthorities = c.Defaults.CertAuthorities
+	}
+	if len(newCfg.AllowedClients) == 0 {
+		newCfg.AllowedClients = c.Defaults.AllowedClients
+	}
 	if len(newCfg.AllowedCommands) == 0 {
 		newCfg.AllowedCommands = c.Defaults.AllowedCommands
 	}
+	return &newCfg
+}
+
+// GetHostConfig returns the configuration for a specific host with the
+// REMOTE_* environment overrides applied.
+func (c *Config) GetHostConfig(host string) *HostConfig {
+	newCfg := c.MergedHostConfig(host)
+	if _, ok := c.Hosts[host]; !ok {
+		return newCfg
+	}
 
 	// Environment Overrides
 	if envUser := os.Getenv("REMOTE_USER"); envUser != "" {
@@ -242,7 +620,7 @@ func (c *Config) GetHostConfig(host string) *HostConfig {
 		newCfg.IgnoreHostKey = (envIgnore == "true" || envIgnore == "1" || envIgnore == "yes")
 	}
 
-	return &newCfg
+	return newCfg
 }
 
 // LoadConfig reads the configuration from a JSON file
@@ -269,7 +647,56 @@ func LoadDefaultConfig() (*Config, error) {
 	return &config, nil
 }
 
+// UserConfigPath is where a user's configuration overrides the embedded one.
+func UserConfigPath(homeDir string) string {
+	return filepath.Join(homeDir, ".config", "remote", "config.json")
+}
+
+// Load returns the user's configuration if it exists, or the embedded
+// default configuration otherwise.
+func Load(homeDir string) (*Config, error) {
+	configPath := UserConfigPath(homeDir)
+	if _, err := os.Stat(configPath); err != nil {
+		return LoadDefaultConfig()
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading user configuration from %s: %w", configPath, err)
+	}
+	return cfg, nil
+}
+
+// RuntimeDir is where daemon sockets and locks live: under $XDG_RUNTIME_DIR,
+// which is local and per-user, or a per-user directory in the system's
+// temporary directory when it isn't set. Home directories are avoided since
+// they may be on NFS, where sockets and flock misbehave.
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, AppDir)
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", AppDir, os.Getuid()))
+}
+
+// StateDir is where daemon logs are kept: under $XDG_STATE_HOME, or
+// ~/.local/state when it isn't set.
+func StateDir(homeDir string) string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, AppDir)
+	}
+	return filepath.Join(homeDir, ".local", "state", AppDir)
+}
+
+// LogPath is the log file of the daemon for identity.
+func LogPath(homeDir, identity string) string {
+	return filepath.Join(StateDir(homeDir), identity+".log")
+}
+
+// AuditLogPath is the default audit log, shared by every daemon.
+func AuditLogPath(homeDir string) string {
+	return filepath.Join(StateDir(homeDir), "audit.log")
+}
+
 // ResolveSocketPath calculates the absolute path for the unix socket.
-func ResolveSocketPath(homeDir, identity string) string {
-	return filepath.Join(homeDir, SocketSubDir, identity+".sock")
+func ResolveSocketPath(identity string) string {
+	return filepath.Join(RuntimeDir(), identity+".sock")
 }
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandHosts(t *testing.T) {
+	cfg := &Config{
+		Hosts: map[string]HostConfig{
+			"db1":  {},
+			"db2":  {},
+			"web1": {},
+			"web2": {},
+		},
+		Groups: map[string][]string{
+			"web":    {"web1", "web2"},
+			"all":    {"db*", "web"},
+			"extra":  {"build", "web1"},
+			"broken": {"x*"},
+		},
+	}
+
+	tests := []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{spec: "db1", want: []string{"db1"}},
+		{spec: "unconfigured", want: []string{"unconfigured"}},
+		{spec: "db1,web1", want: []string{"db1", "web1"}},
+		{spec: " db1 , ,web1,", want: []string{"db1", "web1"}},
+		{spec: "db*", want: []string{"db1", "db2"}},
+		{spec: "*1", want: []string{"db1", "web1"}},
+		{spec: "web?", want: []string{"web1", "web2"}},
+		{spec: "db[2]", want: []string{"db2"}},
+		{spec: "web", want: []string{"web1", "web2"}},
+		{spec: "extra", want: []string{"build", "web1"}},
+		{spec: "web1,web,web*", want: []string{"web1", "web2"}},
+		// Groups are not expanded inside groups, so "web" is taken as a host
+		{spec: "all", want: []string{"db1", "db2", "web"}},
+		{spec: "", wantErr: true},
+		{spec: " , ", wantErr: true},
+		{spec: "x*", wantErr: true},
+		{spec: "broken", wantErr: true},
+		{spec: "db[", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := cfg.ExpandHosts(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ExpandHosts(%q) = %v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ExpandHosts(%q) error: %v", tt.spec, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ExpandHosts(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ktoks/remote/internal/config"
+	"github.com/ktoks/remote/internal/ipc"
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// agentDaemon is the single daemon serving every host when the configuration
+// enables agent mode. Each host gets the same server a per-host daemon would
+// run, connected when it is first used and dropped once it has been idle.
+type agentDaemon struct {
+	homeDir string
+	cfg     *config.Config
+
+	mu      sync.Mutex
+	servers map[string]*server
+}
+
+// StartAgent runs the agent daemon. Clients open each connection with a
+// Hello naming the host, then talk to it as they would to its own daemon.
+func StartAgent(homeDir string, ready *os.File) {
+	setupDaemonLogging(homeDir, config.AgentIdentity)
+	log.Println("Agent starting.")
+
+	fail := func(err error) {
+		ipc.NotifyFailed(ready, newStartupError(err, nil))
+		log.Fatal(err)
+	}
+
+	cfg, err := loadConfig(homeDir)
+	if err != nil {
+		fail(err)
+	}
+
+	listener, release, err := listen(config.AgentIdentity)
+	if errors.Is(err, ipc.ErrLocked) {
+		ipc.NotifyStarted(ready, ipc.StartBusy)
+		log.Fatal(err)
+	}
+	if err != nil {
+		fail(err)
+	}
+	defer release()
+	ipc.NotifyStarted(ready, ipc.StartReady)
+
+	a := &agentDaemon{homeDir: homeDir, cfg: cfg, servers: make(map[string]*server)}
+	defer a.closeAll()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go a.reap(stop)
+
+	serveLoop(listener, a.busy, a.serve)
+}
+
+// serve reads the connection's Hello and hands it to the host's server.
+func (a *agentDaemon) serve(conn net.Conn) {
+	// Security: Check the user before connecting anywhere on its behalf
+	if _, err := peerOf(conn); err != nil {
+		log.Printf("Refused connection: %v", err)
+		sendError(protocol.NewEncoder(conn), fmt.Sprintf("connection refused: %v", err), 1)
+		closeConn(conn)
+		return
+	}
+
+	host, err := readHello(conn)
+	if err != nil {
+		sendError(protocol.NewEncoder(conn), err.Error(), 1)
+		closeConn(conn)
+		return
+	}
+	srv, err := a.server(host)
+	if err != nil {
+		sendError(protocol.NewEncoder(conn), err.Error(), 255)
+		closeConn(conn)
+		return
+	}
+	srv.serve(conn)
+}
+
+func readHello(conn net.Conn) (string, error) {
+	pkt, err := protocol.ReadPacket(conn)
+	if err != nil {
+		return "", fmt.Errorf("reading hello: %w", err)
+	}
+	if pkt.Type != protocol.TypeHello {
+		return "", fmt.Errorf("expected hello from client, got packet type %#x", pkt.Type)
+	}
+	var hello protocol.Hello
+	if err := json.Unmarshal(pkt.Data, &hello); err != nil {
+		return "", fmt.Errorf("invalid hello: %w", err)
+	}
+	if hello.Host == "" {
+		return "", fmt.Errorf("hello names no host")
+	}
+	return hello.Host, nil
+}
+
+// server returns the host's server, starting its master connection if it
+// has none.
+func (a *agentDaemon) server(host string) (*server, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if srv, ok := a.servers[host]; ok {
+		// Keep the reaper off it until the client is counted as active
+		atomic.StoreInt64(&srv.lastUsed, time.Now().UnixNano())
+		return srv, nil
+	}
+
+	// The agent outlives many edits to the configuration, so read it again
+	// for each host it connects; a tightened policy must not wait for the
+	// agent to exit
+	cfg, err := loadConfig(a.homeDir)
+	if err != nil {
+		return nil, newStartupError(err, nil)
+	}
+	a.cfg = cfg
+
+	// The agent's environment came from whichever client started it, so
+	// REMOTE_* overrides in it must not apply to every host
+	hostCfg := a.cfg.MergedHostConfig(host)
+	audit, err := openAuditLog(a.homeDir, hostCfg.Audit)
+	if err != nil {
+		return nil, newStartupError(configError{fmt.Errorf("failed to open audit log: %w", err)}, hostCfg)
+	}
+	srv := newServer(host, hostCfg, audit)
+	atomic.StoreInt64(&srv.lastUsed, time.Now().UnixNano())
+	a.servers[host] = srv
+	log.Printf("Connecting to %s.", host)
+
+	go func() {
+		if err := srv.connect(a.homeDir); err != nil {
+			// Keep the failure until a client has heard why, then forget
+			// it so the next client tries again.
+			select {
+			case <-srv.reported:
+			case <-time.After(failureGrace):
+			}
+			a.drop(host, srv)
+		}
+	}()
+	return srv, nil
+}
+
+// drop closes the host's server if it is still the current one.
+func (a *agentDaemon) drop(host string, srv *server) {
+	a.mu.Lock()
+	if a.servers[host] == srv {
+		delete(a.servers, host)
+	}
+	a.mu.Unlock()
+
+	srv.close()
+	srv.audit.close()
+}
+
+// reap drops the servers of hosts that have been idle for
+// config.IdleTimeout, as their own daemons would have exited.
+func (a *agentDaemon) reap(stop <-chan struct{}) {
+	ticker := time.NewTicker(config.IdleTimeout / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		a.mu.Lock()
+		var idle []*server
+		for host, srv := range a.servers {
+			if !srv.busy() && time.Since(srv.idleSince()) > config.IdleTimeout {
+				log.Printf("Idle timeout reached for %s. Disconnecting.", host)
+				delete(a.servers, host)
+				idle = append(idle, srv)
+			}
+		}
+		a.mu.Unlock()
+
+		for _, srv := range idle {
+			srv.close()
+			srv.audit.close()
+		}
+	}
+}
+
+// busy reports whether any host is still connected. The agent exits once
+// every host has been reaped and no client has connected for a while.
+func (a *agentDaemon) busy() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.servers) > 0
+}
+
+func (a *agentDaemon) closeAll() {
+	a.mu.Lock()
+	servers := a.servers
+	a.servers = make(map[string]*server)
+	a.mu.Unlock()
+
+	for _, srv := range servers {
+		srv.close()
+		srv.audit.close()
+	}
+}
+
+func closeConn(conn net.Conn) {
+	if close_err := conn.Close(); close_err != nil {
+		log.Println("connection close error: ", close_err)
+	}
+}
@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"encoding/json"
+	"log"
+	"log/syslog"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ktoks/remote/internal/config"
+	"github.com/ktoks/remote/internal/ipc"
+)
+
+// Audit decisions
+const (
+	auditAllowed = "allowed"
+	auditDenied  = "denied"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	UID        int       `json:"uid"`
+	PID        int       `json:"pid,omitempty"` // Client process, from SO_PEERCRED
+	Host       string    `json:"host"`
+	Command    string    `json:"command"`
+	Decision   string    `json:"decision"`
+	Rule       string    `json:"rule,omitempty"` // Policy that allowed or denied the request
+	ExitCode   int       `json:"exit_code"`
+	DurationMS int64     `json:"duration_ms"`
+	BytesOut   int64     `json:"bytes_out"` // Output returned to the client
+}
+
+// auditLog appends entries as JSON lines to a file opened in append-only
+// mode, and optionally to syslog. A nil auditLog records nothing.
+type auditLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	syslog *syslog.Writer
+}
+
+func openAuditLog(homeDir string, cfg *config.AuditConfig) (*auditLog, error) {
+	if cfg != nil && cfg.Disabled {
+		return nil, nil
+	}
+	path := config.AuditLogPath(homeDir)
+	if cfg != nil && cfg.Path != "" {
+		path = cfg.Path
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{file: f}
+
+	if cfg != nil && cfg.Syslog {
+		if a.syslog, err = syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "remote"); err != nil {
+			log.Printf("WARNING: audit entries will not be sent to syslog: %v", err)
+		}
+	}
+	log.Printf("Auditing requests to %s", path)
+	return a, nil
+}
+
+// record completes the entry's duration and writes it. Each entry is a
+// single write so lines from daemons sharing the file don't interleave.
+func (a *auditLog) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	e.DurationMS = time.Since(e.Time).Milliseconds()
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error occurred encoding audit entry: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error occurred writing audit log: %v", err)
+	}
+	if a.syslog != nil {
+		if err := a.syslog.Info(string(line)); err != nil {
+			log.Printf("Error occurred writing audit entry to syslog: %v", err)
+		}
+	}
+}
+
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	if close_err := a.file.Close(); close_err != nil {
+		log.Println("audit log close error: ", close_err)
+	}
+	if a.syslog != nil {
+		if close_err := a.syslog.Close(); close_err != nil {
+			log.Println("syslog close error: ", close_err)
+		}
+	}
+}
+
+// newAuditEntry starts an entry for a request from peer, which is nil when
+// the platform can't identify it.
+func (s *server) newAuditEntry(peer *ipc.Peer, command string) auditEntry {
+	e := auditEntry{Time: time.Now(), UID: os.Getuid(), Host: s.host, Command: command}
+	if peer != nil {
+		e.UID, e.PID = peer.UID, peer.PID
+	}
+	e.User = strconv.Itoa(e.UID)
+	if u, err := user.LookupId(e.User); err == nil {
+		e.User = u.Username
+	}
+	return e
+}
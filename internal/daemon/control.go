@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"github.com/ktoks/remote/internal/protocol"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// policyError marks requests refused by the host's security rules.
+type policyError struct{ error }
+
+// handleControl runs a daemon control request, replying as a command would.
+func (s *server) handleControl(client *ssh.Client, c *clientConn, data []byte) {
+	enc := c.encoder
+
+	var ctl protocol.Control
+	if err := json.Unmarshal(data, &ctl); err != nil {
+		sendError(enc, fmt.Sprintf("invalid control request: %v", err), 1)
+		return
+	}
+
+	entry := s.newAuditEntry(c.peer, describeControl(&ctl))
+	defer func() { s.audit.record(entry) }()
+
+	var (
+		out bytes.Buffer
+		err error
+	)
+	switch ctl.Op {
+	case protocol.OpForward:
+		err = s.startForward(client, ctl.Forward, &out)
+	case protocol.OpListForwards:
+		s.listForwards(&out)
+	case protocol.OpCancelForward:
+		if err = s.forwards.cancel(ctl.ID); err == nil {
+			fmt.Fprintf(&out, "Forward %d cancelled\n", ctl.ID)
+		}
+	case protocol.OpPush:
+		err = s.pushFile(c, ctl.Transfer, &out)
+	case protocol.OpPull:
+		err = s.pullFile(c, ctl.Transfer)
+	case protocol.OpSync:
+		err = s.syncDir(c, ctl.Sync, &out)
+	case protocol.OpScript:
+		// Scripts report the remote exit status themselves
+		s.runScript(c, ctl.Script, &entry)
+		return
+	default:
+		err = fmt.Errorf("unknown control operation %q", ctl.Op)
+	}
+
+	entry.Decision, entry.Rule = auditAllowed, controlRule(ctl.Op)
+	if err != nil {
+		entry.ExitCode = 1
+		var policyErr policyError
+		if errors.As(err, &policyErr) {
+			entry.Decision, entry.Rule = auditDenied, err.Error()
+			sendRejection(enc, err)
+			return
+		}
+		sendError(enc, err.Error(), 1)
+		return
+	}
+	if out.Len() > 0 {
+		if enc_err := enc.Encode(protocol.TypeStdout, out.Bytes()); enc_err != nil {
+			log.Printf("Error occured encoding STDOUT: %v", enc_err)
+		}
+	}
+	if enc_err := enc.Encode(protocol.TypeExit, intToBytes(0)); enc_err != nil {
+		log.Printf("Error occured encoding exit code: %v", enc_err)
+	}
+}
+
+// describeControl summarizes a control request for the audit log.
+func describeControl(ctl *protocol.Control) string {
+	switch {
+	case ctl.Forward != nil:
+		return fmt.Sprintf("%s %s %s -> %s", ctl.Op, ctl.Forward.Kind, ctl.Forward.Listen, ctl.Forward.Target)
+	case ctl.Transfer != nil:
+		return ctl.Op + " " + ctl.Transfer.Path
+	case ctl.Sync != nil:
+		return ctl.Op + " " + ctl.Sync.Path
+	case ctl.Script != nil:
+		return ctl.Op + ": " + ctl.Script.Body
+	case ctl.Op == protocol.OpCancelForward:
+		return fmt.Sprintf("%s %d", ctl.Op, ctl.ID)
+	}
+	return ctl.Op
+}
+
+// controlRule names the policy setting that governs a control operation.
+func controlRule(op string) string {
+	switch op {
+	case protocol.OpForward:
+		return "allow_forwarding"
+	case protocol.OpPush, protocol.OpPull, protocol.OpSync:
+		return "allowed_paths"
+	}
+	return ""
+}
+
+func (s *server) startForward(client *ssh.Client, fwd *protocol.Forward, out *bytes.Buffer) error {
+	// Security: Forwards bypass command validation entirely
+	if !s.cfg.Rules().AllowForwarding {
+		return policyError{errors.New("port forwarding is disabled")}
+	}
+	if fwd == nil {
+		return fmt.Errorf("missing forward specification")
+	}
+
+	pf, err := s.forwards.start(client, *fwd)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Forward %d: %s %s -> %s\n", pf.ID, pf.Kind, pf.Listen, pf.Target)
+	return nil
+}
+
+func (s *server) listForwards(out *bytes.Buffer) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKIND\tLISTEN\tTARGET\tCONNS")
+	for _, pf := range s.forwards.list() {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\n", pf.ID, pf.Kind, pf.Listen, pf.Target, atomic.LoadInt32(&pf.conns))
+	}
+	if err := tw.Flush(); err != nil {
+		log.Println("forward list error: ", err)
+	}
+}
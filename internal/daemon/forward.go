@@ -0,0 +1,178 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ktoks/remote/internal/protocol"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// portForward is an active forward and the listener feeding it.
+type portForward struct {
+	protocol.Forward
+	listener net.Listener
+	conns    int32
+}
+
+// forwardRegistry tracks the port forwards running over the master
+// connection so they can be listed and cancelled by later clients.
+type forwardRegistry struct {
+	mu     sync.Mutex
+	nextID int
+	active map[int]*portForward
+}
+
+func newForwardRegistry() *forwardRegistry {
+	return &forwardRegistry{active: make(map[int]*portForward)}
+}
+
+// start opens the listener for fwd and begins proxying connections.
+func (r *forwardRegistry) start(client *ssh.Client, fwd protocol.Forward) (*portForward, error) {
+	var (
+		listener net.Listener
+		dial     func(network, addr string) (net.Conn, error)
+		err      error
+	)
+	switch fwd.Kind {
+	case protocol.ForwardLocal:
+		listener, err = net.Listen("tcp", fwd.Listen)
+		dial = client.Dial
+	case protocol.ForwardRemote:
+		listener, err = client.Listen("tcp", fwd.Listen)
+		dial = net.Dial
+	case protocol.ForwardDynamic:
+		listener, err = net.Listen("tcp", fwd.Listen)
+		fwd.Target = "socks5" // Each connection names its own target
+	default:
+		return nil, fmt.Errorf("unknown forward kind %q", fwd.Kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", fwd.Listen, err)
+	}
+
+	r.mu.Lock()
+	r.nextID++
+	fwd.ID = r.nextID
+	fwd.Listen = listener.Addr().String() // Reports the port picked for :0
+	pf := &portForward{Forward: fwd, listener: listener}
+	r.active[fwd.ID] = pf
+	r.mu.Unlock()
+
+	// open connects an accepted connection to its target
+	open := func(net.Conn) (net.Conn, error) {
+		return dial("tcp", pf.Target)
+	}
+	if fwd.Kind == protocol.ForwardDynamic {
+		open = func(conn net.Conn) (net.Conn, error) {
+			return socksConnect(conn, client.Dial)
+		}
+	}
+
+	log.Printf("Forward %d: %s %s -> %s", fwd.ID, fwd.Kind, fwd.Listen, fwd.Target)
+	go pf.serve(open)
+	return pf, nil
+}
+
+// cancel stops a forward. Connections already proxied are left to finish.
+func (r *forwardRegistry) cancel(id int) error {
+	r.mu.Lock()
+	pf, ok := r.active[id]
+	delete(r.active, id)
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no forward with ID %d", id)
+	}
+	log.Printf("Forward %d cancelled", id)
+	return pf.listener.Close()
+}
+
+// list returns the active forwards ordered by ID.
+func (r *forwardRegistry) list() []*portForward {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	forwards := make([]*portForward, 0, len(r.active))
+	for _, pf := range r.active {
+		forwards = append(forwards, pf)
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].ID < forwards[j].ID })
+	return forwards
+}
+
+// count returns the number of active forwards.
+func (r *forwardRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.active)
+}
+
+// closeAll stops every forward, e.g. when the daemon shuts down.
+func (r *forwardRegistry) closeAll() {
+	for _, pf := range r.list() {
+		if err := r.cancel(pf.ID); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("forward close error: ", err)
+		}
+	}
+}
+
+func (pf *portForward) serve(open func(net.Conn) (net.Conn, error)) {
+	for {
+		conn, err := pf.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && err != io.EOF {
+				log.Printf("Forward %d accept error: %v", pf.ID, err)
+			}
+			return
+		}
+
+		go func() {
+			atomic.AddInt32(&pf.conns, 1)
+			defer atomic.AddInt32(&pf.conns, -1)
+
+			target, err := open(conn)
+			if err != nil {
+				log.Printf("Forward %d: connect failed: %v", pf.ID, err)
+				if close_err := conn.Close(); close_err != nil {
+					log.Println("forward connection close error: ", close_err)
+				}
+				return
+			}
+			proxy(conn, target)
+		}()
+	}
+}
+
+// proxy copies data both ways, passing on half-closes, and closes both
+// connections once each direction is done.
+func proxy(a, b net.Conn) {
+	var wg sync.WaitGroup
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("forward copy error: ", err)
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+
+	if close_err := a.Close(); close_err != nil && !errors.Is(close_err, net.ErrClosed) {
+		log.Println("forward connection close error: ", close_err)
+	}
+	if close_err := b.Close(); close_err != nil && !errors.Is(close_err, net.ErrClosed) {
+		log.Println("forward connection close error: ", close_err)
+	}
+}
@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ktoks/remote/internal/config"
+	"github.com/ktoks/remote/internal/protocol"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/sys/unix"
+)
+
+// hostKeyCallback builds the host key verification for a connection.
+// Certificates signed by a configured CA are checked with ssh.CertChecker;
+// everything else (plain keys and @cert-authority lines) goes to known_hosts.
+func hostKeyCallback(home string, hostCfg *config.HostConfig, prompts *prompter) (ssh.HostKeyCallback, error) {
+	if hostCfg.IgnoreHostKey {
+		log.Println("WARNING: Host key verification is disabled for this connection.")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	authorities, err := parseCertAuthorities(hostCfg.CertAuthorities)
+	if err != nil {
+		return nil, err
+	}
+
+	// Enterprise Strictness: Always check known_hosts
+	knownHostPath := filepath.Join(home, ".ssh", "known_hosts")
+	knownCallback, err := knownhosts.New(knownHostPath)
+	if err != nil {
+		if !os.IsNotExist(err) || (len(authorities) == 0 && !hostCfg.TrustOnFirstUse) {
+			return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+		}
+		// CA-only and TOFU setups don't need a known_hosts file yet
+		knownCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return &knownhosts.KeyError{}
+		}
+	}
+	if hostCfg.TrustOnFirstUse {
+		knownCallback = trustOnFirstUse(knownHostPath, knownCallback, prompts)
+	}
+
+	if len(authorities) == 0 {
+		return knownCallback, nil
+	}
+	log.Printf("Trusting %d configured host certificate authorities", len(authorities))
+
+	isAuthority := func(auth ssh.PublicKey, address string) bool {
+		for _, ca := range authorities {
+			if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+				return true
+			}
+		}
+		return false
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: isAuthority,
+		HostKeyFallback: knownCallback,
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// Certificates from other CAs may still be trusted via @cert-authority in known_hosts
+		if cert, ok := key.(*ssh.Certificate); ok && !isAuthority(cert.SignatureKey, hostname) {
+			return knownCallback(hostname, remote, key)
+		}
+		return checker.CheckHostKey(hostname, remote, key)
+	}, nil
+}
+
+// parseCertAuthorities parses CA public keys in authorized_keys format.
+func parseCertAuthorities(entries []string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, entry := range entries {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert authority %q: %w", entry, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// trustOnFirstUse wraps a known_hosts callback so that hosts without any
+// entry are shown to the user, and recorded if accepted. A key that differs
+// from a known one is still rejected outright.
+func trustOnFirstUse(knownHostPath string, known ssh.HostKeyCallback, prompts *prompter) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+		if prompts == nil {
+			return fmt.Errorf("unknown host key for %s and no client to confirm it", hostname)
+		}
+
+		log.Printf("Unknown host key for %s, asking client: %s", hostname, ssh.FingerprintSHA256(key))
+		question := fmt.Sprintf("The authenticity of host '%s (%s)' can't be established.\n"+
+			"%s key fingerprint is %s.\n"+
+			"Are you sure you want to continue connecting (yes/no)? ",
+			knownhosts.Normalize(hostname), remote, key.Type(), ssh.FingerprintSHA256(key))
+
+		answers, err := prompts.Ask(protocol.Prompt{Questions: []protocol.Question{{Text: question, Echo: true}}})
+		if err != nil {
+			return fmt.Errorf("host key for %s not accepted: %w", hostname, err)
+		}
+		if len(answers) != 1 || strings.ToLower(strings.TrimSpace(answers[0])) != "yes" {
+			return fmt.Errorf("host key for %s rejected by user", hostname)
+		}
+
+		if err := appendKnownHost(knownHostPath, knownhosts.Line([]string{hostname}, key)); err != nil {
+			return fmt.Errorf("failed to record host key: %w", err)
+		}
+		log.Printf("Added %s key for %s to %s", key.Type(), hostname, knownHostPath)
+		return nil
+	}
+}
+
+// appendKnownHost adds a line to known_hosts. The new contents are written to
+// a temporary file and renamed into place so readers never see a partial
+// file; the directory lock serializes daemons for different hosts.
+func appendKnownHost(path, line string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if close_err := dirFile.Close(); close_err != nil {
+			log.Println("directory close error: ", close_err)
+		}
+	}()
+	if err := unix.Flock(int(dirFile.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("lock %s: %w", dir, err)
+	}
+	defer func() {
+		if lock_err := unix.Flock(int(dirFile.Fd()), unix.LOCK_UN); lock_err != nil {
+			log.Println("directory unlock error: ", lock_err)
+		}
+	}()
+
+	contents, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 && contents[len(contents)-1] != '\n' {
+		contents = append(contents, '\n')
+	}
+	contents = append(contents, line+"\n"...)
+
+	tmp, err := os.CreateTemp(dir, ".known_hosts-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if os_err := os.Remove(tmp.Name()); os_err != nil && !os.IsNotExist(os_err) {
+			log.Println("error occurred removing temporary known_hosts: ", os_err)
+		}
+	}()
+
+	if _, err := tmp.Write(contents); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,85 @@
+package daemon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ktoks/remote/internal/config"
+)
+
+// commandLimiter enforces the host's command limits across every client of
+// the daemon.
+type commandLimiter struct {
+	running   chan struct{} // Slots for concurrent commands; nil when unlimited
+	perMinute int
+	queue     bool
+
+	mu     sync.Mutex
+	starts []time.Time // Start times of commands in the last minute
+}
+
+func newCommandLimiter(limits *config.CommandLimits) *commandLimiter {
+	l := &commandLimiter{}
+	if limits == nil {
+		return l
+	}
+	if limits.MaxConcurrent > 0 {
+		l.running = make(chan struct{}, limits.MaxConcurrent)
+	}
+	l.perMinute, l.queue = limits.PerMinute, limits.Queue
+	return l
+}
+
+// admit reserves capacity for a command, waiting for it if the host queues
+// commands. It returns a function to call once the command has finished, or
+// an error if the command is refused.
+func (l *commandLimiter) admit() (func(), error) {
+	if l.running != nil {
+		select {
+		case l.running <- struct{}{}:
+		default:
+			if !l.queue {
+				return nil, fmt.Errorf("too many commands running on the host (limit %d)", cap(l.running))
+			}
+			l.running <- struct{}{}
+		}
+	}
+	release := func() {
+		if l.running != nil {
+			<-l.running
+		}
+	}
+
+	for {
+		wait := l.reserveStart()
+		if wait == 0 {
+			return release, nil
+		}
+		if !l.queue {
+			release()
+			return nil, fmt.Errorf("rate limit of %d commands per minute reached, retry in %s", l.perMinute, (wait + time.Second - 1).Truncate(time.Second))
+		}
+		time.Sleep(wait)
+	}
+}
+
+// reserveStart records a command start if the rate limit allows one now, or
+// returns how long until it will.
+func (l *commandLimiter) reserveStart() time.Duration {
+	if l.perMinute <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for len(l.starts) > 0 && now.Sub(l.starts[0]) >= time.Minute {
+		l.starts = l.starts[1:]
+	}
+	if len(l.starts) < l.perMinute {
+		l.starts = append(l.starts, now)
+		return 0
+	}
+	return l.starts[0].Add(time.Minute).Sub(now)
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ktoks/remote/internal/config"
+)
+
+func TestCommandLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   *config.CommandLimits
+		admits   int    // Commands started without finishing
+		admitted int    // How many of them should be let through
+		wantErr  string // Error for the ones refused
+	}{
+		{name: "no limits", limits: nil, admits: 20, admitted: 20},
+		{name: "zero limits", limits: &config.CommandLimits{}, admits: 20, admitted: 20},
+		{name: "concurrency", limits: &config.CommandLimits{MaxConcurrent: 2}, admits: 4, admitted: 2, wantErr: "too many commands running"},
+		{name: "rate", limits: &config.CommandLimits{PerMinute: 3}, admits: 5, admitted: 3, wantErr: "rate limit of 3 commands per minute"},
+		{name: "both", limits: &config.CommandLimits{MaxConcurrent: 2, PerMinute: 5}, admits: 3, admitted: 2, wantErr: "too many commands running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newCommandLimiter(tt.limits)
+			for i := range tt.admits {
+				release, err := l.admit()
+				if i < tt.admitted {
+					if err != nil {
+						t.Fatalf("admit %d: %v", i+1, err)
+					}
+					defer release()
+					continue
+				}
+				if err == nil {
+					release()
+					t.Fatalf("admit %d succeeded, want error", i+1)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("admit %d error = %q, want it to contain %q", i+1, err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestCommandLimiterRelease(t *testing.T) {
+	l := newCommandLimiter(&config.CommandLimits{MaxConcurrent: 1})
+	release, err := l.admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.admit(); err == nil {
+		t.Fatal("second admit succeeded while the first command runs")
+	}
+	release()
+	release, err = l.admit()
+	if err != nil {
+		t.Fatalf("admit after release: %v", err)
+	}
+	release()
+}
+
+func TestCommandLimiterRateRefusal(t *testing.T) {
+	// A refused start must not hold a concurrency slot
+	l := newCommandLimiter(&config.CommandLimits{MaxConcurrent: 1, PerMinute: 1})
+	release, err := l.admit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, err := l.admit(); err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Fatalf("admit = %v, want rate limit error", err)
+	}
+	if len(l.running) != 0 {
+		t.Errorf("%d slots held after a refused command, want 0", len(l.running))
+	}
+}
+
+func TestCommandLimiterQueue(t *testing.T) {
+	t.Run("concurrency", func(t *testing.T) {
+		l := newCommandLimiter(&config.CommandLimits{MaxConcurrent: 1, Queue: true})
+		release, err := l.admit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		admitted := make(chan error)
+		go func() {
+			release, err := l.admit()
+			if err == nil {
+				release()
+			}
+			admitted <- err
+		}()
+		select {
+		case err := <-admitted:
+			t.Fatalf("queued admit returned %v while the first command runs", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		release()
+		select {
+		case err := <-admitted:
+			if err != nil {
+				t.Fatalf("queued admit: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued admit did not return after release")
+		}
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		l := newCommandLimiter(&config.CommandLimits{PerMinute: 1, Queue: true})
+		// The last start falls out of the window shortly
+		l.starts = []time.Time{time.Now().Add(-time.Minute + 100*time.Millisecond)}
+		start := time.Now()
+		release, err := l.admit()
+		if err != nil {
+			t.Fatalf("queued admit: %v", err)
+		}
+		release()
+		if waited := time.Since(start); waited < 50*time.Millisecond {
+			t.Errorf("admit returned after %v, want it to wait for the window", waited)
+		}
+	})
+}
+
+func TestReserveStart(t *testing.T) {
+	l := newCommandLimiter(&config.CommandLimits{PerMinute: 2})
+	now := time.Now()
+	l.starts = []time.Time{now.Add(-2 * time.Minute), now.Add(-30 * time.Second)}
+	if wait := l.reserveStart(); wait != 0 {
+		t.Fatalf("reserveStart = %v, want 0 once old starts expire", wait)
+	}
+	if len(l.starts) != 2 {
+		t.Fatalf("%d starts recorded, want 2", len(l.starts))
+	}
+	wait := l.reserveStart()
+	if wait <= 25*time.Second || wait > 30*time.Second {
+		t.Errorf("reserveStart = %v, want about 30s", wait)
+	}
+}
@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/ktoks/remote/internal/ipc"
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// peerOf identifies the process connecting to the socket and refuses any
+// running as another user. The peer is nil where the platform can't tell.
+func peerOf(conn net.Conn) (*ipc.Peer, error) {
+	peer, err := ipc.PeerCredentials(conn)
+	if errors.Is(err, ipc.ErrNoPeerCredentials) {
+		return nil, nil // Rely on the socket directory's permissions
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot identify client: %w", err)
+	}
+
+	// Security: Another user reaching the socket must not borrow our login
+	if uid := os.Getuid(); peer.UID != uid {
+		return peer, fmt.Errorf("client uid %d is not the daemon's uid %d", peer.UID, uid)
+	}
+	return peer, nil
+}
+
+// authorize checks that a client may use the master connection: it must
+// run as the daemon's own user, and through the host's allowed_clients when
+// it lists any. The peer is returned for auditing even when it is refused.
+func (s *server) authorize(conn net.Conn) (*ipc.Peer, error) {
+	peer, err := peerOf(conn)
+	if err != nil || len(s.cfg.AllowedClients) == 0 {
+		return peer, err
+	}
+	if peer == nil {
+		return nil, fmt.Errorf("cannot identify client: %w", ipc.ErrNoPeerCredentials)
+	}
+	exe, err := peer.Executable()
+	if err != nil {
+		return peer, fmt.Errorf("cannot identify client program: %w", err)
+	}
+	if !s.cfg.IsClientAllowed(exe) {
+		return peer, fmt.Errorf("client program %s is not in allowed_clients", exe)
+	}
+	return peer, nil
+}
+
+// reject tells a refused client why and records the attempt.
+func (s *server) reject(conn net.Conn, peer *ipc.Peer, reason error) {
+	defer func() {
+		if close_err := conn.Close(); close_err != nil {
+			log.Println("connection close error: ", close_err)
+		}
+	}()
+	log.Printf("Refused connection: %v", reason)
+
+	entry := s.newAuditEntry(peer, "connect")
+	entry.Decision, entry.Rule, entry.ExitCode = auditDenied, reason.Error(), 1
+	s.audit.record(entry)
+
+	sendError(protocol.NewEncoder(conn), fmt.Sprintf("connection refused: %v", reason), 1)
+}
@@ -0,0 +1,198 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ktoks/remote/internal/ipc"
+	"github.com/ktoks/remote/internal/protocol"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// promptTimeout bounds how long the daemon waits for a user to answer.
+	promptTimeout = 2 * time.Minute
+	// maxAuthPrompts matches OpenSSH's default NumberOfPasswordPrompts.
+	maxAuthPrompts = 3
+)
+
+var errPromptDeclined = errors.New("prompt declined by client")
+
+// clientConn is a local client connection. The reader is kept alongside the
+// connection so prompt replies and later requests share one buffer.
+type clientConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	encoder *protocol.Encoder
+	peer    *ipc.Peer // Connecting process, when the platform reports it
+
+	// desynced is set when a request was cut short and the rest of the
+	// stream can no longer be parsed; no further requests are read.
+	desynced bool
+}
+
+func newClientConn(conn net.Conn) *clientConn {
+	return &clientConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		encoder: protocol.NewEncoder(conn),
+	}
+}
+
+// ask sends a prompt and waits for the client's reply.
+func (c *clientConn) ask(prompt protocol.Prompt) ([]string, error) {
+	if err := c.encoder.EncodeJSON(protocol.TypePrompt, prompt); err != nil {
+		return nil, err
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(promptTimeout)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if deadline_err := c.SetReadDeadline(time.Time{}); deadline_err != nil {
+			log.Println("clearing read deadline failed: ", deadline_err)
+		}
+	}()
+
+	pkt, err := protocol.ReadPacket(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Type != protocol.TypeReply {
+		return nil, fmt.Errorf("unexpected packet type %#x while waiting for reply", pkt.Type)
+	}
+
+	var reply protocol.Reply
+	if err := json.Unmarshal(pkt.Data, &reply); err != nil {
+		return nil, fmt.Errorf("invalid reply: %w", err)
+	}
+	if reply.Answers == nil {
+		return nil, errPromptDeclined
+	}
+	return reply.Answers, nil
+}
+
+// prompter relays questions raised while the master connection is being
+// established to clients that are waiting for it. The daemon is detached
+// from any terminal, so these clients are the only way to reach the user.
+type prompter struct {
+	mu      sync.Mutex
+	clients []*clientConn
+	arrived chan struct{}
+}
+
+func newPrompter() *prompter {
+	return &prompter{arrived: make(chan struct{}, 1)}
+}
+
+// add offers a waiting client for answering prompts.
+func (p *prompter) add(c *clientConn) {
+	p.mu.Lock()
+	p.clients = append(p.clients, c)
+	p.mu.Unlock()
+
+	select {
+	case p.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// remove withdraws a client, e.g. once the master is up or it went away.
+func (p *prompter) remove(c *clientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, waiting := range p.clients {
+		if waiting == c {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// next returns the longest waiting client, usually the one that spawned us.
+func (p *prompter) next(deadline <-chan time.Time) (*clientConn, error) {
+	for {
+		p.mu.Lock()
+		if len(p.clients) > 0 {
+			c := p.clients[0]
+			p.mu.Unlock()
+			return c, nil
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.arrived:
+		case <-deadline:
+			return nil, errors.New("no client connected to answer prompt")
+		}
+	}
+}
+
+// Ask puts the prompt to a waiting client, moving on to the next one if
+// the client disconnects before answering.
+func (p *prompter) Ask(prompt protocol.Prompt) ([]string, error) {
+	deadline := time.After(promptTimeout)
+	for {
+		c, err := p.next(deadline)
+		if err != nil {
+			return nil, err
+		}
+		answers, err := c.ask(prompt)
+		if err == nil || errors.Is(err, errPromptDeclined) {
+			return answers, err
+		}
+		log.Printf("Prompt failed, trying next client: %v", err)
+		p.remove(c)
+	}
+}
+
+// keyboardInteractive answers server challenges (e.g. OTP codes) by asking
+// the user through a waiting client.
+func keyboardInteractive(prompts *prompter) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		// Servers may send empty rounds, e.g. to display a banner
+		if len(questions) == 0 {
+			return []string{}, nil
+		}
+
+		prompt := protocol.Prompt{Instruction: strings.TrimSpace(name + "\n" + instruction)}
+		for i, question := range questions {
+			prompt.Questions = append(prompt.Questions, protocol.Question{Text: question, Echo: echos[i]})
+		}
+		log.Printf("Relaying %d keyboard-interactive question(s) to client", len(questions))
+
+		answers, err := prompts.Ask(prompt)
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != len(questions) {
+			return nil, fmt.Errorf("expected %d answers, got %d", len(questions), len(answers))
+		}
+		return answers, nil
+	}
+}
+
+// passwordPrompt asks the user for the account password through a waiting client.
+func passwordPrompt(prompts *prompter, user, address string) func() (string, error) {
+	return func() (string, error) {
+		log.Println("Relaying password prompt to client")
+		answers, err := prompts.Ask(protocol.Prompt{Questions: []protocol.Question{
+			{Text: fmt.Sprintf("%s@%s's password: ", user, address)},
+		}})
+		if err != nil {
+			return "", err
+		}
+		if len(answers) != 1 {
+			return "", fmt.Errorf("expected 1 answer, got %d", len(answers))
+		}
+		return answers[0], nil
+	}
+}
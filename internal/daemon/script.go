@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ktoks/remote/internal/config"
+	"github.com/ktoks/remote/internal/protocol"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// runScript validates a client's script statement by statement and runs it
+// in a single session by piping it to the remote interpreter. The outcome
+// is filled into entry.
+func (s *server) runScript(c *clientConn, script *protocol.Script, entry *auditEntry) {
+	enc := c.encoder
+	entry.Decision, entry.ExitCode = auditDenied, 1
+	if script == nil {
+		sendError(enc, "missing script", 1)
+		return
+	}
+
+	// Security: The client checks too, but only the daemon's check counts
+	rules, err := s.cfg.ValidateShellScript(script.Body)
+	if err != nil {
+		entry.Rule = err.Error()
+		sendRejection(enc, err)
+		return
+	}
+
+	dir, within, err := s.checkOptions(script.Options)
+	if err != nil {
+		entry.Rule = err.Error()
+		sendRejection(enc, err)
+		return
+	}
+
+	cmd, err := scriptCommand(script)
+	if err == nil {
+		cmd, err = inDir(cmd, dir, within)
+	}
+	if err != nil {
+		entry.Rule = err.Error()
+		sendError(enc, err.Error(), 1)
+		return
+	}
+	release, err := s.limits.admit()
+	if err != nil {
+		entry.Rule, entry.ExitCode = err.Error(), protocol.ExitBusy
+		sendError(enc, "remote: "+err.Error(), protocol.ExitBusy)
+		return
+	}
+	defer release()
+
+	entry.Decision, entry.Rule = auditAllowed, strings.Join(rules, ", ")
+	entry.ExitCode, entry.BytesOut = s.runSession(cmd, enc, sessionOptions{
+		stdin:        strings.NewReader(script.Body),
+		forwardAgent: s.forwardAgent && s.cfg.IsAgentForwardingAllowed(script.Body),
+		timeout:      config.ShorterTimeout(s.cfg.CommandTimeout(script.Body), time.Duration(script.Options.TimeoutMS)*time.Millisecond),
+		env:          script.Options.Env,
+		sendEnv:      s.acceptedSendEnv(script.Options.SendEnv),
+	})
+}
+
+// scriptCommand builds the interpreter invocation for a script: bash when
+// the shebang asks for it, sh otherwise, reading the script from stdin.
+// Shell options in the shebang (such as -eu) are kept, so the script never
+// runs with weaker settings than it asked for.
+func scriptCommand(script *protocol.Script) (string, error) {
+	interpreter := "sh"
+	var options []string
+	if first, _, _ := strings.Cut(script.Body, "\n"); strings.HasPrefix(first, "#!") {
+		fields := strings.Fields(strings.TrimPrefix(first, "#!"))
+		if len(fields) > 0 && path.Base(fields[0]) == "env" {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && path.Base(fields[0]) == "bash" {
+			interpreter = "bash"
+		}
+		if len(fields) > 1 {
+			var err error
+			if options, err = shellOptions(fields[1:]); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	cmd := interpreter
+	for _, option := range options {
+		cmd += " " + option
+	}
+	cmd += " -s --"
+	for _, arg := range script.Args {
+		quoted, err := syntax.Quote(arg, syntax.LangPOSIX)
+		if err != nil {
+			return "", fmt.Errorf("invalid script argument %q: %w", arg, err)
+		}
+		cmd += " " + quoted
+	}
+	return cmd, nil
+}
+
+// shellOptions checks the options on a script's shebang line. Only single
+// letter flags (-e, -eux, +x) and named options (-o pipefail) are passed on;
+// anything else, including -c, -i and -s, would change how the script is
+// read and is refused.
+func shellOptions(fields []string) ([]string, error) {
+	var options []string
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "-o" || field == "+o":
+			if i+1 == len(fields) || !isOptionName(fields[i+1]) {
+				return nil, fmt.Errorf("unsupported shebang options: %s", strings.Join(fields, " "))
+			}
+			options = append(options, field, fields[i+1])
+			i++
+		case len(field) > 1 && (field[0] == '-' || field[0] == '+') && isOptionName(field[1:]) && !strings.ContainsAny(field[1:], "cis"):
+			options = append(options, field)
+		default:
+			return nil, fmt.Errorf("unsupported shebang options: %s", strings.Join(fields, " "))
+		}
+	}
+	return options, nil
+}
+
+// isOptionName reports whether s is made only of ASCII letters, so it is
+// safe in a command line without quoting.
+func isOptionName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -1,15 +1,17 @@
 package daemon
 
 import (
-	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,84 +23,193 @@ import (
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/knownhosts"
+	"mvdan.cc/sh/v3/syntax"
 )
 
-// Start initiates the SSH master process.
-func Start(host, linkName, homeDir string) {
+// Start initiates the SSH master process. A client that spawned the daemon
+// passes ready to learn when it is listening, or why it failed to start.
+func Start(host, linkName, homeDir string, ready *os.File) {
 	// 1. Setup Logging
 	setupDaemonLogging(homeDir, linkName)
 	log.Printf("Daemon starting for %s.", host)
 
-	// Load default embedded configuration
-	cfg, err := config.LoadDefaultConfig()
-	if err != nil {
-		log.Fatalf("Failed to load embedded configuration: %v", err)
+	var hostCfg *config.HostConfig
+	fail := func(err error) {
+		ipc.NotifyFailed(ready, newStartupError(err, hostCfg))
+		log.Fatal(err)
 	}
 
-	// Override with user configuration if it exists
-	configPath := filepath.Join(homeDir, ".config", "remote", "config.json")
-	if _, err := os.Stat(configPath); err == nil {
-		userCfg, err := config.LoadConfig(configPath)
-		if err != nil {
-			log.Fatalf("Error loading user configuration from %s: %v", configPath, err)
-		}
-		cfg = userCfg
-		log.Printf("Loaded user configuration from %s", configPath)
+	cfg, err := loadConfig(homeDir)
+	if err != nil {
+		fail(err)
 	}
+	hostCfg = cfg.GetHostConfig(host)
 
-	hostCfg := cfg.GetHostConfig(host)
+	audit, err := openAuditLog(homeDir, hostCfg.Audit)
+	if err != nil {
+		fail(configError{fmt.Errorf("failed to open audit log: %w", err)})
+	}
+	defer audit.close()
+
+	// 2. Lock and 3. Listen
+	// This happens before the SSH connection so that waiting clients can
+	// answer prompts raised during the handshake.
+	listener, release, err := listen(linkName)
+	if errors.Is(err, ipc.ErrLocked) {
+		ipc.NotifyStarted(ready, ipc.StartBusy)
+		log.Fatal(err)
+	}
+	if err != nil {
+		fail(err)
+	}
+	defer release()
+	ipc.NotifyStarted(ready, ipc.StartReady)
+
+	// 4. Establish SSH Connection
+	srv := newServer(host, hostCfg, audit)
+	go func() {
+		if err := srv.connect(homeDir); err != nil {
+			// Give the spawning client a chance to connect and learn why
+			// before we stop accepting and exit.
+			select {
+			case <-srv.reported:
+			case <-time.After(failureGrace):
+			}
+			if close_err := listener.Close(); close_err != nil {
+				log.Println("listener close error: ", close_err)
+			}
+		}
+	}()
+	defer srv.close()
 
-	// 2. Lock
-	socketPath := config.ResolveSocketPath(homeDir, linkName)
-	lockPath := filepath.Join(filepath.Dir(socketPath), linkName+".lock")
+	// 5. Accept Loop
+	serveLoop(listener, srv.busy, srv.serve)
+}
 
-	lockFile, err := ipc.AcquireLock(lockPath)
+// loadConfig loads the user's configuration, falling back to the embedded
+// default.
+func loadConfig(homeDir string) (*config.Config, error) {
+	cfg, err := config.Load(homeDir)
 	if err != nil {
-		log.Fatalf("Failed to acquire lock: %v", err)
+		return nil, configError{fmt.Errorf("failed to load configuration: %w", err)}
+	}
+	if _, err := os.Stat(config.UserConfigPath(homeDir)); err == nil {
+		log.Printf("Loaded user configuration from %s", config.UserConfigPath(homeDir))
+	}
+	return cfg, nil
+}
+
+// listen takes the lock of the daemon for identity and listens on its
+// socket. The returned function closes the socket and releases the lock.
+func listen(identity string) (net.Listener, func(), error) {
+	socketPath := config.ResolveSocketPath(identity)
+	if err := ipc.EnsurePrivateDir(filepath.Dir(socketPath)); err != nil {
+		return nil, nil, fmt.Errorf("refusing to use runtime directory: %w", err)
 	}
-	defer ipc.ReleaseLock(lockFile)
+	lockPath := filepath.Join(filepath.Dir(socketPath), identity+".lock")
 
-	// 3. Establish SSH Connection
-	client, err := createSSHClient(homeDir, hostCfg)
+	lockFile, err := ipc.AcquireLock(lockPath)
 	if err != nil {
-		log.Fatalf("error occurred starting ssh connection: %v", err)
+		return nil, nil, fmt.Errorf("failed to acquire lock: %w", err)
 	}
-	defer func() {
-		if close_err := client.Close(); close_err != nil {
-			log.Println("client close error: ", close_err)
-		}
-	}()
 
-	// 4. Setup Unix Socket Listener
-	if os_err := os.Remove(socketPath); os_err != nil {
-		if !os.IsNotExist(os_err) {
-			log.Fatalf("Failed to remove stale socket: %v", os_err)
-		}
+	if os_err := os.Remove(socketPath); os_err != nil && !os.IsNotExist(os_err) {
+		ipc.ReleaseLock(lockFile)
+		return nil, nil, fmt.Errorf("failed to remove stale socket: %w", os_err)
 	}
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		log.Fatalf("Failed to listen on socket: %v", err)
+		ipc.ReleaseLock(lockFile)
+		return nil, nil, fmt.Errorf("failed to listen on socket: %w", err)
 	}
-	defer func() {
-		if close_err := listener.Close(); close_err != nil {
+	log.Printf("Listening on %s", socketPath)
+
+	release := func() {
+		if close_err := listener.Close(); close_err != nil && !errors.Is(close_err, net.ErrClosed) {
 			log.Println("listener close error: ", close_err)
 		}
-	}()
-	defer func() {
-		if os_err := os.Remove(socketPath); os_err != nil {
+		if os_err := os.Remove(socketPath); os_err != nil && !os.IsNotExist(os_err) {
 			log.Println("error occurred removing completed socket: ", os_err)
 		}
-	}()
+		ipc.ReleaseLock(lockFile)
+	}
+	return listener, release, nil
+}
 
-	log.Printf("Listening on %s", socketPath)
+// failureGrace is how long a daemon whose SSH connection failed keeps
+// listening so that a client can be told the reason.
+const failureGrace = 5 * time.Second
+
+// server holds the state shared by all client connections of a daemon.
+type server struct {
+	host        string
+	cfg         *config.HostConfig
+	audit       *auditLog
+	limits      *commandLimiter
+	prompts     *prompter
+	forwards    *forwardRegistry
+	activeConns int32
+	lastUsed    int64 // Unix nanoseconds when the last client disconnected
+
+	ready        chan struct{} // Closed once the master connection is up or has failed
+	client       *ssh.Client
+	err          error
+	forwardAgent bool         // Agent channels are served; sessions may request forwarding
+	sessions     *sessionPool // Session slots on the master and any extra connections
+
+	reported     chan struct{} // Closed once a client has been sent the startup error
+	reportedOnce sync.Once
+}
 
-	// 5. Accept Loop
-	serveLoop(listener, client, hostCfg)
+func newServer(host string, cfg *config.HostConfig, audit *auditLog) *server {
+	return &server{
+		host:     host,
+		cfg:      cfg,
+		audit:    audit,
+		limits:   newCommandLimiter(cfg.Limits),
+		prompts:  newPrompter(),
+		forwards: newForwardRegistry(),
+		ready:    make(chan struct{}),
+		reported: make(chan struct{}),
+	}
 }
 
-func serveLoop(listener net.Listener, sshClient *ssh.Client, cfg *config.HostConfig) {
-	var activeConns int32
+// setMaster records the outcome of the SSH handshake and releases waiting clients.
+func (s *server) setMaster(client *ssh.Client, err error) {
+	s.client, s.err = client, err
+	close(s.ready)
+}
+
+// connecting reports whether the SSH handshake is still in progress.
+func (s *server) connecting() bool {
+	select {
+	case <-s.ready:
+		return false
+	default:
+		return true
+	}
+}
+
+// awaitMaster blocks until the master connection is established. While
+// waiting, the client is available to answer prompts.
+func (s *server) awaitMaster(c *clientConn) (*ssh.Client, error) {
+	if s.connecting() {
+		s.prompts.add(c)
+		<-s.ready
+		s.prompts.remove(c)
+	}
+	return s.client, s.err
+}
+
+// serveLoop accepts connections, handing each to handle, until the daemon
+// has been idle for config.IdleTimeout. busy reports work that outlives
+// connections, such as port forwards.
+func serveLoop(listener net.Listener, busy func() bool, handle func(net.Conn)) {
+	var (
+		wg     sync.WaitGroup
+		active int32
+	)
+	defer wg.Wait()
 
 	for {
 		// Set deadline to kill daemon if idle
@@ -110,70 +221,342 @@ func serveLoop(listener net.Listener, sshClient *ssh.Client, cfg *config.HostCon
 		conn, err := listener.Accept()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				if atomic.LoadInt32(&activeConns) > 0 {
-					continue // Active connections exist, extend life
+				if atomic.LoadInt32(&active) > 0 || busy() {
+					continue // Active connections or forwards exist, extend life
 				}
 				log.Println("Idle timeout reached. Shutting down.")
 				return
 			}
-			log.Printf("Accept error: %v", err)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Accept error: %v", err)
+			}
 			return
 		}
 
-		atomic.AddInt32(&activeConns, 1)
+		atomic.AddInt32(&active, 1)
+		wg.Add(1)
 		go func() {
-			defer atomic.AddInt32(&activeConns, -1)
-			handleConnection(conn, sshClient, cfg)
+			defer wg.Done()
+			defer atomic.AddInt32(&active, -1)
+			handle(conn)
 		}()
 	}
 }
 
-func handleConnection(conn net.Conn, client *ssh.Client, cfg *config.HostConfig) {
+// connect establishes the master connection and releases clients waiting
+// for it.
+func (s *server) connect(homeDir string) error {
+	client, err := createSSHClient(homeDir, s.cfg, s.prompts)
+	if err != nil {
+		log.Printf("error occurred starting ssh connection: %v", err)
+	} else {
+		if s.cfg.ForwardAgent {
+			s.forwardAgent = setupAgentForwarding(client)
+		}
+		s.sessions = newSessionPool(client, s.cfg.SessionLimit(), s.cfg.ConnectionLimit(), func() (*ssh.Client, error) {
+			// Nobody waits on an extra connection, so it mustn't prompt
+			extra, err := createSSHClient(homeDir, s.cfg, nil)
+			if err == nil && s.forwardAgent {
+				setupAgentForwarding(extra)
+			}
+			return extra, err
+		})
+	}
+	s.setMaster(client, err)
+	return err
+}
+
+// close stops the server's forwards and its master connection.
+func (s *server) close() {
+	s.forwards.closeAll()
+	<-s.ready
+	if s.client == nil {
+		return
+	}
+	s.sessions.close()
+	if close_err := s.client.Close(); close_err != nil {
+		log.Println("client close error: ", close_err)
+	}
+}
+
+// busy reports whether the server has clients, forwards or a handshake in
+// progress, and so must not be shut down.
+func (s *server) busy() bool {
+	return atomic.LoadInt32(&s.activeConns) > 0 || s.connecting() || s.forwards.count() > 0
+}
+
+// idleSince reports when the server's last client disconnected.
+func (s *server) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastUsed))
+}
+
+// serve authorizes a client connection and runs its commands.
+func (s *server) serve(conn net.Conn) {
+	atomic.AddInt32(&s.activeConns, 1)
+	defer atomic.AddInt32(&s.activeConns, -1)
+	defer atomic.StoreInt64(&s.lastUsed, time.Now().UnixNano())
+
+	peer, err := s.authorize(conn)
+	if err != nil {
+		s.reject(conn, peer, err)
+		return
+	}
+	s.handleConnection(conn, peer)
+}
+
+func (s *server) handleConnection(conn net.Conn, peer *ipc.Peer) {
 	defer func() {
 		if close_err := conn.Close(); close_err != nil {
 			log.Println("connection close error: ", close_err)
 		}
 	}()
-	encoder := protocol.NewEncoder(conn)
-	reader := bufio.NewReader(conn)
+	c := newClientConn(conn)
+	c.peer = peer
+	encoder := c.encoder
+
+	client, err := s.awaitMaster(c)
+	if err != nil {
+		startErr := newStartupError(fmt.Errorf("failed to connect to %s: %w", s.cfg.Address, err), s.cfg)
+		if enc_err := encoder.EncodeJSON(protocol.TypeStartupError, startErr); enc_err != nil {
+			log.Printf("Error occured encoding startup error: %v", enc_err)
+		}
+		if sendError(encoder, startErr.Error(), 255) {
+			s.reportedOnce.Do(func() { close(s.reported) })
+		}
+		return
+	}
+
+	// Greet the client so it knows commands can be sent
+	if enc_err := encoder.Encode(protocol.TypeReady, nil); enc_err != nil {
+		log.Printf("Error occured encoding READY: %v", enc_err)
+		return
+	}
 
 	// Limit concurrency per client connection
 	sem := make(chan struct{}, 50)
 	var wg sync.WaitGroup
 
 	for {
-		cmdStr, err := reader.ReadString('\n')
+		next, err := c.reader.Peek(1)
 		if err != nil {
 			break
 		}
-		cmdStr = strings.TrimSpace(cmdStr)
-		if cmdStr == "" {
+		if next[0] == protocol.TypeControl {
+			pkt, err := protocol.ReadPacket(c.reader)
+			if err != nil {
+				log.Printf("Error reading control request: %v", err)
+				break
+			}
+			s.handleControl(client, c, pkt.Data)
+			if c.desynced {
+				break
+			}
+			continue
+		}
+
+		var req protocol.Request
+		if next[0] == protocol.TypeRequest {
+			pkt, err := protocol.ReadPacket(c.reader)
+			if err != nil {
+				log.Printf("Error reading command request: %v", err)
+				break
+			}
+			decoded, err := protocol.DecodeRequest(pkt.Data)
+			if err != nil {
+				sendError(encoder, fmt.Sprintf("invalid command request: %v", err), 1)
+				continue
+			}
+			req = *decoded
+		} else if !startsCommandLine(next[0]) {
+			// A packet out of place, such as a late prompt reply, must never
+			// be read as a command
+			log.Printf("Unexpected packet type %#x from client, closing connection", next[0])
+			sendError(encoder, fmt.Sprintf("unexpected packet type %#x", next[0]), 1)
+			break
+		} else {
+			// Compatibility: plain newline-terminated command line from older clients
+			cmdStr, err := c.reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			req.Command = cmdStr
+		}
+		req.Command = strings.TrimSpace(req.Command)
+		if req.Command == "" {
 			continue
 		}
 
 		sem <- struct{}{}
 		wg.Add(1)
-		go func(cmd string) {
+		go func(req protocol.Request) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			execRemote(client, cmd, encoder, cfg)
-		}(cmdStr)
+			s.execRemote(c, req)
+		}(req)
 	}
 	wg.Wait()
 }
 
-func execRemote(client *ssh.Client, cmd string, enc *protocol.Encoder, cfg *config.HostConfig) {
+// startsCommandLine reports whether b can begin a plain-text command line.
+// Tab is left out: it is also TypeDataEnd, which clients send.
+func startsCommandLine(b byte) bool {
+	return (b >= ' ' && b != 0x7f) || b == '\n' || b == '\r'
+}
+
+func (s *server) execRemote(c *clientConn, req protocol.Request) {
+	entry := s.newAuditEntry(c.peer, req.Command)
+	defer func() { s.audit.record(entry) }()
+
+	run, rules, err := s.checkRequest(req)
+	if err != nil {
+		var policyErr policyError
+		if errors.As(err, &policyErr) {
+			sendRejection(c.encoder, err)
+		} else {
+			sendError(c.encoder, err.Error(), 1)
+		}
+		entry.Decision, entry.Rule, entry.ExitCode = auditDenied, err.Error(), 1
+		return
+	}
+
+	release, err := s.limits.admit()
+	if err != nil {
+		sendError(c.encoder, "remote: "+err.Error(), protocol.ExitBusy)
+		entry.Decision, entry.Rule, entry.ExitCode = auditDenied, err.Error(), protocol.ExitBusy
+		return
+	}
+	defer release()
+
+	cmd := req.Command
+	entry.Decision, entry.Rule = auditAllowed, strings.Join(rules, ", ")
+	entry.ExitCode, entry.BytesOut = s.runSession(run, c.encoder, sessionOptions{
+		// Security: Only hand the agent to commands the policy allows
+		forwardAgent: s.forwardAgent && s.cfg.IsAgentForwardingAllowed(cmd),
+		timeout:      config.ShorterTimeout(s.cfg.CommandTimeout(cmd), time.Duration(req.Options.TimeoutMS)*time.Millisecond),
+		env:          req.Options.Env,
+		sendEnv:      s.acceptedSendEnv(req.Options.SendEnv),
+	})
+}
+
+// checkRequest applies the host's policy to a request and returns the
+// command line to run for it, with the policy entries that allowed it.
+func (s *server) checkRequest(req protocol.Request) (string, []string, error) {
 	// Security: Validate the command using AST analysis
-	if err := cfg.ValidateShellCommand(cmd); err != nil {
-		errMsg := fmt.Sprintf("Security violation: %v\n", err)
-		if enc_err := enc.Encode(protocol.TypeStderr, []byte(errMsg)); enc_err != nil {
-			log.Printf("Error occured encoding STDERR: %v", enc_err)
+	rules, err := s.cfg.ValidateShellCommand(req.Command)
+	if err != nil {
+		return "", nil, policyError{err}
+	}
+	dir, within, err := s.checkOptions(req.Options)
+	if err != nil {
+		return "", nil, err
+	}
+	run, err := inDir(req.Command, dir, within)
+	return run, rules, err
+}
+
+// checkOptions applies the host's policy to a request's options and
+// returns the directory to run it in. A directory the client chose comes
+// with the allowed directories its real path must still lie within.
+func (s *server) checkOptions(opts protocol.RequestOptions) (string, []string, error) {
+	// Security: Only variables the policy names may be set
+	for name := range opts.Env {
+		if !validEnvName(name) || !s.cfg.IsEnvAllowed(name) {
+			return "", nil, policyError{fmt.Errorf("environment variable not allowed: %s", name)}
 		}
-		if enc_err := enc.Encode(protocol.TypeExit, intToBytes(1)); enc_err != nil {
-			log.Printf("Error occured encoding exit code: %v", enc_err)
+	}
+
+	// Security: The directory is quoted into a prefix the daemon adds itself,
+	// so the command doesn't need chaining to change directory
+	if opts.Dir == "" {
+		return s.cfg.DefaultDir, nil, nil
+	}
+	if !s.cfg.IsDirAllowed(opts.Dir) {
+		return "", nil, policyError{fmt.Errorf("directory not allowed: %s", opts.Dir)}
+	}
+	return path.Clean(opts.Dir), s.cfg.Rules().AllowedDirs, nil
+}
+
+// acceptedSendEnv returns the send_env variables the host's policy allows.
+// Unlike explicit ones, a refused variable is only logged.
+func (s *server) acceptedSendEnv(env map[string]string) map[string]string {
+	accepted := make(map[string]string, len(env))
+	for name, value := range env {
+		if !validEnvName(name) || !s.cfg.IsEnvAllowed(name) {
+			log.Printf("Skipping send_env variable %s: not in allowed_env", name)
+			continue
 		}
-		return
+		accepted[name] = value
+	}
+	return accepted
+}
+
+// inDir prefixes cmd with a change to dir, if one is given. The shell exits
+// if the change fails, so no part of cmd runs anywhere else. With within,
+// the directory's real path is checked on the host as well: the policy only
+// sees the path as text, and a symlink below an allowed directory could
+// lead anywhere.
+func inDir(cmd, dir string, within []string) (string, error) {
+	if dir == "" {
+		return cmd, nil
+	}
+	quoted, err := syntax.Quote(dir, syntax.LangPOSIX)
+	if err != nil {
+		return "", fmt.Errorf("invalid directory %q: %w", dir, err)
+	}
+	if len(within) == 0 {
+		return "cd -- " + quoted + " || exit 1\n" + cmd, nil
+	}
+
+	var patterns []string
+	for _, allowed := range within {
+		allowed = path.Clean(allowed)
+		exact, err := syntax.Quote(allowed, syntax.LangPOSIX)
+		if err != nil {
+			return "", fmt.Errorf("invalid allowed directory %q: %w", allowed, err)
+		}
+		below := "/*"
+		if parent := strings.TrimSuffix(allowed, "/"); parent != "" {
+			below = exact + "/*"
+		}
+		patterns = append(patterns, exact, below)
+	}
+	refusal, err := syntax.Quote("remote: directory not allowed: "+dir, syntax.LangPOSIX)
+	if err != nil {
+		return "", err
 	}
+	return "cd -P -- " + quoted + " || exit 1\n" +
+		"case $(pwd -P) in " + strings.Join(patterns, "|") + ") ;; *) echo " + refusal + " >&2; exit 1 ;; esac\n" +
+		cmd, nil
+}
+
+// validEnvName reports whether name is a portable environment variable name.
+func validEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionOptions adjust how runSession runs a command.
+type sessionOptions struct {
+	stdin        io.Reader
+	forwardAgent bool
+	timeout      time.Duration // Zero means no limit
+	env          map[string]string
+	sendEnv      map[string]string // Skipped rather than failing if the host refuses them
+}
+
+// runSession runs an already validated command in a new session on the
+// master and relays its output and exit status, which it returns along with
+// the number of output bytes.
+func (s *server) runSession(cmd string, enc *protocol.Encoder, opts sessionOptions) (int, int64) {
+	client, release := s.sessions.acquire()
+	defer release()
 
 	session, err := client.NewSession()
 	if err != nil {
@@ -184,7 +567,7 @@ func execRemote(client *ssh.Client, cmd string, enc *protocol.Encoder, cfg *conf
 		if enc_err := enc.Encode(protocol.TypeExit, intToBytes(255)); enc_err != nil {
 			log.Printf("Error occured encoding exit code: %v", enc_err)
 		}
-		return
+		return 255, 0
 	}
 	defer func() {
 		if close_err := session.Close(); close_err != nil {
@@ -196,7 +579,26 @@ func execRemote(client *ssh.Client, cmd string, enc *protocol.Encoder, cfg *conf
 		}
 	}()
 
-	output, err := session.CombinedOutput(cmd)
+	if opts.forwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			log.Printf("agent forwarding request failed: %v", err)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(opts.env)) {
+		if err := session.Setenv(name, opts.env[name]); err != nil {
+			// OpenSSH only accepts names listed in the server's AcceptEnv
+			sendError(enc, fmt.Sprintf("SSH session error: remote host refused to set %s (check AcceptEnv in its sshd_config)", name), 255)
+			return 255, 0
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(opts.sendEnv)) {
+		if err := session.Setenv(name, opts.sendEnv[name]); err != nil {
+			log.Printf("Remote host refused send_env variable %s, skipping it", name)
+		}
+	}
+	session.Stdin = opts.stdin
+
+	output, timedOut, err := runWithTimeout(session, cmd, opts.timeout)
 
 	// Send Output
 	if len(output) > 0 {
@@ -205,6 +607,12 @@ func execRemote(client *ssh.Client, cmd string, enc *protocol.Encoder, cfg *conf
 		}
 	}
 
+	if timedOut {
+		log.Printf("Command timed out after %s: %s", opts.timeout, cmd)
+		sendError(enc, fmt.Sprintf("remote: command timed out after %s", opts.timeout), protocol.ExitTimeout)
+		return protocol.ExitTimeout, int64(len(output))
+	}
+
 	// Determine Exit Code
 	exitCode := 0
 	if err != nil {
@@ -221,10 +629,81 @@ func execRemote(client *ssh.Client, cmd string, enc *protocol.Encoder, cfg *conf
 	if enc_err := enc.Encode(protocol.TypeExit, intToBytes(exitCode)); enc_err != nil {
 		log.Printf("Error occured encoding exit code: %v", enc_err)
 	}
+	return exitCode, int64(len(output))
+}
+
+// killGrace is how long a timed out command has to exit after SIGTERM
+// before its session is closed.
+const killGrace = 5 * time.Second
+
+// runWithTimeout runs cmd, and if it is still running after timeout sends
+// it SIGTERM, then closes the session if it hasn't exited within killGrace.
+// The output collected up to that point is returned.
+func runWithTimeout(session *ssh.Session, cmd string, timeout time.Duration) ([]byte, bool, error) {
+	if timeout <= 0 {
+		output, err := session.CombinedOutput(cmd)
+		return output, false, err
+	}
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := session.CombinedOutput(cmd)
+		done <- result{output, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.output, false, r.err
+	case <-timer.C:
+	}
+
+	if err := session.Signal(ssh.SIGTERM); err != nil {
+		log.Printf("Error signalling timed out command: %v", err)
+	}
+	select {
+	case r := <-done:
+		return r.output, true, r.err
+	case <-time.After(killGrace):
+	}
+	if close_err := session.Close(); close_err != nil && close_err != io.EOF {
+		log.Println("session close error: ", close_err)
+	}
+	r := <-done
+	return r.output, true, r.err
 }
 
 // Helpers
 
+// sendError reports a failure the way a command would: a message on stderr
+// followed by an exit code. It returns false if the client could not be told.
+func sendError(enc *protocol.Encoder, msg string, code int) bool {
+	if enc_err := enc.Encode(protocol.TypeStderr, []byte(msg+"\n")); enc_err != nil {
+		log.Printf("Error occured encoding STDERR: %v", enc_err)
+		return false
+	}
+	if enc_err := enc.Encode(protocol.TypeExit, intToBytes(code)); enc_err != nil {
+		log.Printf("Error occured encoding exit code: %v", enc_err)
+		return false
+	}
+	return true
+}
+
+// sendRejection tells the client that policy refused its request, then sends
+// the message and exit code older clients rely on.
+func sendRejection(enc *protocol.Encoder, err error) bool {
+	if enc_err := enc.Encode(protocol.TypeRejected, []byte(err.Error())); enc_err != nil {
+		log.Printf("Error occured encoding rejection: %v", enc_err)
+		return false
+	}
+	return sendError(enc, fmt.Sprintf("Security violation: %v", err), 1)
+}
+
 func intToBytes(n int) []byte {
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b, uint32(n))
@@ -232,7 +711,11 @@ func intToBytes(n int) []byte {
 }
 
 func setupDaemonLogging(homeDir, identity string) {
-	logPath := filepath.Join(homeDir, config.SocketSubDir, identity+".log")
+	if err := ipc.EnsurePrivateDir(config.StateDir(homeDir)); err != nil {
+		log.Printf("ERROR: Cannot use log directory: %v", err)
+		return
+	}
+	logPath := config.LogPath(homeDir, identity)
 	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		log.Printf("ERROR: Failed to open log file %s: %v", logPath, err)
@@ -244,23 +727,38 @@ func setupDaemonLogging(homeDir, identity string) {
 	log.SetOutput(f)
 }
 
-func createSSHClient(home string, hostCfg *config.HostConfig) (*ssh.Client, error) {
+// setupAgentForwarding serves agent channels opened by the remote host from
+// the local SSH_AUTH_SOCK. Each session still has to request forwarding.
+func setupAgentForwarding(client *ssh.Client) bool {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		log.Println("WARNING: forward_agent is set but SSH_AUTH_SOCK is empty, agent forwarding disabled.")
+		return false
+	}
+	if err := agent.ForwardToRemote(client, sock); err != nil {
+		log.Printf("WARNING: agent forwarding disabled: %v", err)
+		return false
+	}
+	log.Printf("Forwarding agent from %s", sock)
+	return true
+}
+
+// createSSHClient connects and authenticates to the host. Without prompts
+// nothing can be asked of the user, so password and keyboard-interactive
+// auth are left out and unknown host keys are refused.
+func createSSHClient(home string, hostCfg *config.HostConfig, prompts *prompter) (*ssh.Client, error) {
 	// Host Key Verification
-	var hostKeyCallback ssh.HostKeyCallback
-	if hostCfg.IgnoreHostKey {
-		hostKeyCallback = ssh.InsecureIgnoreHostKey()
-		log.Println("WARNING: Host key verification is disabled for this connection.")
-	} else {
-		// Enterprise Strictness: Always check known_hosts
-		knownHostPath := filepath.Join(home, ".ssh", "known_hosts")
-		var err error
-		hostKeyCallback, err = knownhosts.New(knownHostPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load known_hosts: %w", err)
-		}
+	verifyHostKey, err := hostKeyCallback(home, hostCfg, prompts)
+	if err != nil {
+		return nil, hostKeyError{err}
+	}
+
+	sshUser := hostCfg.User
+	if sshUser == "" {
+		sshUser = os.Getenv("USER")
 	}
 
-	// Auth: Agent + Key Files
+	// Auth: Agent + Key Files, then prompts relayed to the client
 	var methods []ssh.AuthMethod
 
 	// 1. Agent
@@ -291,22 +789,26 @@ func createSSHClient(home string, hostCfg *config.HostConfig) (*ssh.Client, erro
 		}
 	}
 
-	if len(methods) == 0 {
-		return nil, errors.New("no valid authentication methods found (agent or keys)")
-	}
-
-	sshUser := hostCfg.User
-	if sshUser == "" {
-		sshUser = os.Getenv("USER")
+	// 3. Keyboard-interactive (OTP/2FA) and password
+	if prompts != nil {
+		methods = append(methods,
+			ssh.RetryableAuthMethod(ssh.KeyboardInteractive(keyboardInteractive(prompts)), maxAuthPrompts),
+			ssh.RetryableAuthMethod(ssh.PasswordCallback(passwordPrompt(prompts, sshUser, hostCfg.Address)), maxAuthPrompts),
+		)
 	}
 
 	log.Printf("Connecting to %s@%s:%s", sshUser, hostCfg.Address, hostCfg.Port)
 
 	cfg := &ssh.ClientConfig{
-		User:            sshUser,
-		Auth:            methods,
-		HostKeyCallback: hostKeyCallback,
-		Timeout:         5 * time.Second,
+		User: sshUser,
+		Auth: methods,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := verifyHostKey(hostname, remote, key); err != nil {
+				return hostKeyError{err}
+			}
+			return nil
+		},
+		Timeout: 5 * time.Second,
 	}
 
 	return ssh.Dial("tcp", net.JoinHostPort(hostCfg.Address, hostCfg.Port), cfg)
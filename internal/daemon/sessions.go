@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	extraIdleTimeout = time.Minute // Extra connections unused this long are closed
+	maxDialBackoff   = time.Minute // Longest wait between failed dials of an extra connection
+)
+
+// sessionPool limits how many sessions (commands, scripts and SFTP
+// transfers) are open at once on each connection to the host, since servers
+// refuse channels beyond their MaxSessions. Work over the limit waits for a
+// free slot or, when the host allows more than one connection, is given an
+// extra connection of its own.
+type sessionPool struct {
+	maxSessions int
+	maxConns    int
+	dial        func() (*ssh.Client, error) // Opens an extra connection
+
+	mu      sync.Mutex
+	free    *sync.Cond // Signalled when a slot is released or a connection added
+	conns   []*pooledConn
+	dialing bool
+	backoff time.Duration // Doubles with each failed dial, reset by a successful one
+	retryAt time.Time     // No dial is tried before this
+	stop    chan struct{}
+	stopped bool
+}
+
+// pooledConn is a connection to the host and its count of open sessions.
+type pooledConn struct {
+	client    *ssh.Client
+	open      int
+	idleSince time.Time // When open last dropped to zero
+}
+
+func newSessionPool(primary *ssh.Client, maxSessions, maxConns int, dial func() (*ssh.Client, error)) *sessionPool {
+	p := &sessionPool{
+		maxSessions: maxSessions,
+		maxConns:    maxConns,
+		dial:        dial,
+		conns:       []*pooledConn{{client: primary}},
+		stop:        make(chan struct{}),
+	}
+	p.free = sync.NewCond(&p.mu)
+	if maxConns > 1 {
+		go p.reapIdle()
+	}
+	return p
+}
+
+// acquire reserves a session slot, waiting for one if every connection is
+// full, and returns the connection to open the session on. release must be
+// called once the session is closed.
+func (p *sessionPool) acquire() (client *ssh.Client, release func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for _, pc := range p.conns {
+			if pc.open < p.maxSessions {
+				pc.open++
+				return pc.client, func() { p.release(pc) }
+			}
+		}
+		if !p.dialing && len(p.conns) < p.maxConns && !time.Now().Before(p.retryAt) {
+			p.addConn()
+			continue
+		}
+		p.free.Wait()
+	}
+}
+
+// addConn opens an extra connection, unlocking the pool while it dials. If
+// the host refuses it, sessions queue on the connections there are and the
+// next dial waits a little longer.
+func (p *sessionPool) addConn() {
+	p.dialing = true
+	p.mu.Unlock()
+	client, err := p.dial()
+	p.mu.Lock()
+	p.dialing = false
+
+	if err != nil {
+		p.backoff = min(max(2*p.backoff, time.Second), maxDialBackoff)
+		p.retryAt = time.Now().Add(p.backoff)
+		log.Printf("Failed to open an extra connection, queueing sessions and retrying in %v: %v", p.backoff, err)
+	} else {
+		p.backoff, p.retryAt = 0, time.Time{}
+		pc := &pooledConn{client: client, idleSince: time.Now()}
+		p.conns = append(p.conns, pc)
+		go p.watch(pc)
+		log.Printf("Opened extra connection %d of %d", len(p.conns), p.maxConns)
+	}
+	p.free.Broadcast()
+}
+
+// watch drops an extra connection from the pool once it has closed, so no
+// more sessions are opened on it.
+func (p *sessionPool) watch(pc *pooledConn) {
+	err := pc.client.Wait()
+	p.mu.Lock()
+	removed := p.remove(pc)
+	p.mu.Unlock()
+	if removed {
+		log.Printf("Extra connection lost: %v", err)
+		p.free.Broadcast()
+	}
+}
+
+// reapIdle closes extra connections that have had no sessions for
+// extraIdleTimeout.
+func (p *sessionPool) reapIdle() {
+	ticker := time.NewTicker(extraIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		var idle []*pooledConn
+		for _, pc := range p.conns[1:] {
+			if pc.open == 0 && time.Since(pc.idleSince) > extraIdleTimeout {
+				idle = append(idle, pc)
+			}
+		}
+		for _, pc := range idle {
+			p.remove(pc)
+		}
+		p.mu.Unlock()
+
+		for _, pc := range idle {
+			log.Printf("Closing idle extra connection")
+			if close_err := pc.client.Close(); close_err != nil {
+				log.Println("client close error: ", close_err)
+			}
+		}
+	}
+}
+
+// remove takes an extra connection out of the pool, reporting whether it
+// was still there. The pool must be locked.
+func (p *sessionPool) remove(pc *pooledConn) bool {
+	i := slices.Index(p.conns, pc)
+	if i < 1 {
+		return false
+	}
+	p.conns = slices.Delete(p.conns, i, i+1)
+	return true
+}
+
+func (p *sessionPool) release(pc *pooledConn) {
+	p.mu.Lock()
+	pc.open--
+	if pc.open == 0 {
+		pc.idleSince = time.Now()
+	}
+	p.mu.Unlock()
+	p.free.Signal()
+}
+
+// close closes the extra connections. The primary belongs to the server.
+func (p *sessionPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.stop)
+	}
+	for _, pc := range p.conns[1:] {
+		if close_err := pc.client.Close(); close_err != nil {
+			log.Println("client close error: ", close_err)
+		}
+	}
+	p.conns = p.conns[:1]
+}
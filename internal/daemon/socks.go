@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 constants (RFC 1928)
+const (
+	socksVersion       = 0x05
+	socksNoAuth        = 0x00
+	socksNoAcceptable  = 0xFF
+	socksCmdConnect    = 0x01
+	socksAddrIPv4      = 0x01
+	socksAddrDomain    = 0x03
+	socksAddrIPv6      = 0x04
+	socksSucceeded     = 0x00
+	socksFailure       = 0x01
+	socksCmdNotSupp    = 0x07
+	socksAddrNotSupp   = 0x08
+	socksHandshakeTime = 30 * time.Second
+)
+
+// socksConnect performs the server side of a SOCKS5 handshake on conn and
+// connects to the requested target with dial. Only unauthenticated CONNECT
+// is supported; the proxy listens on a local address like ssh -D.
+func socksConnect(conn net.Conn, dial func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(socksHandshakeTime)); err != nil {
+		return nil, err
+	}
+
+	// 1. Method negotiation: [VER][NMETHODS][METHODS...]
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("socks: read greeting: %w", err)
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("socks: unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, fmt.Errorf("socks: read methods: %w", err)
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == socksNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return nil, errors.New("socks: client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return nil, err
+	}
+
+	// 2. Request: [VER][CMD][RSV][ATYP][DST.ADDR][DST.PORT]
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, fmt.Errorf("socks: read request: %w", err)
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksCmdNotSupp)
+		return nil, fmt.Errorf("socks: unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if request[3] == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, fmt.Errorf("socks: read address: %w", err)
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, fmt.Errorf("socks: read address: %w", err)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, fmt.Errorf("socks: read address: %w", err)
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddrNotSupp)
+		return nil, fmt.Errorf("socks: unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, fmt.Errorf("socks: read port: %w", err)
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	// 3. Connect through the master and report the outcome
+	remote, err := dial("tcp", target)
+	if err != nil {
+		socksReply(conn, socksFailure)
+		return nil, fmt.Errorf("socks: connect %s: %w", target, err)
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		_ = remote.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = remote.Close()
+		return nil, err
+	}
+	return remote, nil
+}
+
+// socksReply sends a reply with an unspecified bound address; clients
+// connecting through an SSH channel have no meaningful one to use.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocksConnect(t *testing.T) {
+	ipv6 := append([]byte{socksVersion, socksCmdConnect, 0, socksAddrIPv6}, net.IPv6loopback...)
+	tests := []struct {
+		name      string
+		greeting  []byte
+		request   []byte
+		truncated bool  // The client hangs up after sending request
+		dialErr   error // Returned by the dialer
+		target    string
+		method    byte // Method the server selects
+		status    int  // Reply status, or -1 if no reply is expected
+		wantErr   bool
+	}{
+		{
+			name:     "ipv4",
+			greeting: []byte{socksVersion, 1, socksNoAuth},
+			request:  []byte{socksVersion, socksCmdConnect, 0, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			target:   "10.0.0.1:80",
+			status:   socksSucceeded,
+		},
+		{
+			name:     "domain",
+			greeting: []byte{socksVersion, 2, 0x02, socksNoAuth},
+			request:  append([]byte{socksVersion, socksCmdConnect, 0, socksAddrDomain, 11}, "example.com\x01\xbb"...),
+			target:   "example.com:443",
+			status:   socksSucceeded,
+		},
+		{
+			name:     "ipv6",
+			greeting: []byte{socksVersion, 1, socksNoAuth},
+			request:  append(ipv6, 0, 22),
+			target:   "[::1]:22",
+			status:   socksSucceeded,
+		},
+		{
+			name:     "authentication required",
+			greeting: []byte{socksVersion, 1, 0x02},
+			method:   socksNoAcceptable,
+			status:   -1,
+			wantErr:  true,
+		},
+		{
+			name:     "wrong version",
+			greeting: []byte{0x04, 1, socksNoAuth},
+			status:   -1,
+			wantErr:  true,
+		},
+		{
+			name:     "bind command",
+			greeting: []byte{socksVersion, 1, socksNoAuth},
+			request:  []byte{socksVersion, 0x02, 0, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			status:   socksCmdNotSupp,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown address type",
+			greeting: []byte{socksVersion, 1, socksNoAuth},
+			request:  []byte{socksVersion, socksCmdConnect, 0, 0x09},
+			status:   socksAddrNotSupp,
+			wantErr:  true,
+		},
+		{
+			name:      "truncated address",
+			greeting:  []byte{socksVersion, 1, socksNoAuth},
+			request:   []byte{socksVersion, socksCmdConnect, 0, socksAddrIPv4, 10, 0},
+			truncated: true,
+			status:    -1,
+			wantErr:   true,
+		},
+		{
+			name:     "dial failure",
+			greeting: []byte{socksVersion, 1, socksNoAuth},
+			request:  []byte{socksVersion, socksCmdConnect, 0, socksAddrIPv4, 10, 0, 0, 1, 0, 80},
+			dialErr:  errors.New("connection refused"),
+			target:   "10.0.0.1:80",
+			status:   socksFailure,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+
+			// The client side: greeting, then the request once a method is chosen
+			type result struct {
+				method []byte
+				reply  []byte
+			}
+			done := make(chan result)
+			go func() {
+				var r result
+				defer func() {
+					clientConn.Close()
+					done <- r
+				}()
+				if _, err := clientConn.Write(tt.greeting); err != nil {
+					return
+				}
+				r.method = make([]byte, 2)
+				if _, err := io.ReadFull(clientConn, r.method); err != nil {
+					r.method = nil
+					return
+				}
+				if tt.request == nil {
+					return
+				}
+				if tt.truncated {
+					_, _ = clientConn.Write(tt.request)
+					return
+				}
+				// The server may reply before it has read the whole request
+				go func() { _, _ = clientConn.Write(tt.request) }()
+				r.reply, _ = io.ReadAll(clientConn)
+			}()
+
+			var dialed string
+			remote, err := socksConnect(serverConn, func(network, addr string) (net.Conn, error) {
+				dialed = addr
+				if tt.dialErr != nil {
+					return nil, tt.dialErr
+				}
+				local, remote := net.Pipe()
+				local.Close()
+				return remote, nil
+			})
+			serverConn.Close()
+			r := <-done
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("socksConnect error = %v, want error %v", err, tt.wantErr)
+			}
+			if remote != nil {
+				remote.Close()
+			}
+			if dialed != tt.target {
+				t.Errorf("dialed %q, want %q", dialed, tt.target)
+			}
+			if r.method != nil && r.method[1] != tt.method {
+				t.Errorf("selected method %#x, want %#x", r.method[1], tt.method)
+			}
+			switch {
+			case tt.status < 0 && len(r.reply) > 0:
+				t.Errorf("got reply %v, want none", r.reply)
+			case tt.status >= 0 && (len(r.reply) < 2 || r.reply[1] != byte(tt.status)):
+				t.Errorf("got reply %v, want status %#x", r.reply, tt.status)
+			}
+		})
+	}
+}
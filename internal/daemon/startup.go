@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ktoks/remote/internal/config"
+	"github.com/ktoks/remote/internal/protocol"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// configError marks failures to load or apply the configuration.
+type configError struct{ error }
+
+func (e configError) Unwrap() error { return e.error }
+
+// hostKeyError marks failures to verify the host's key, including ones
+// raised inside the handshake's host key callback.
+type hostKeyError struct{ error }
+
+func (e hostKeyError) Unwrap() error { return e.error }
+
+// newStartupError describes err for the client, classifying it and
+// suggesting a fix. hostCfg is nil if the configuration wasn't loaded.
+func newStartupError(err error, hostCfg *config.HostConfig) *protocol.StartupError {
+	e := &protocol.StartupError{Kind: protocol.StartupOther, Message: err.Error()}
+	name, address := "<host>", "the host"
+	if hostCfg != nil {
+		address = net.JoinHostPort(hostCfg.Address, hostCfg.Port)
+		name = knownhosts.Normalize(address)
+	}
+
+	var (
+		cfgErr  configError
+		keyErr  *knownhosts.KeyError
+		hostErr hostKeyError
+		netErr  net.Error
+	)
+	switch {
+	case errors.As(err, &cfgErr):
+		e.Kind = protocol.StartupConfig
+		e.Remedy = "Fix the configuration file (see the error above) and run the command again."
+	case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+		e.Kind = protocol.StartupHostKey
+		e.Remedy = fmt.Sprintf("The key of %s differs from the one in ~/.ssh/known_hosts. "+
+			"If the host was reinstalled, remove the old entry with `ssh-keygen -R '%s'`; otherwise the connection may be intercepted.",
+			address, name)
+	case errors.As(err, &keyErr):
+		e.Kind = protocol.StartupHostKey
+		e.Remedy = fmt.Sprintf("%s is not in ~/.ssh/known_hosts. Connect once with ssh to check and record its key, "+
+			"or set trust_on_first_use for the host to be asked here.", address)
+	case errors.As(err, &hostErr):
+		e.Kind = protocol.StartupHostKey
+		e.Remedy = "Check ~/.ssh/known_hosts and the host's cert_authorities."
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		e.Kind = protocol.StartupAuth
+		user := "your user"
+		if hostCfg != nil && hostCfg.User != "" {
+			user = hostCfg.User
+		}
+		e.Remedy = fmt.Sprintf("Check that %s may log in to %s and that your key is loaded in ssh-agent (ssh-add) "+
+			"or stored in ~/.ssh, and listed in the host's authorized_keys.", user, address)
+	case errors.As(err, &netErr):
+		e.Kind = protocol.StartupNetwork
+		e.Remedy = fmt.Sprintf("Check that %s is reachable: the address and port in the configuration, "+
+			"your network or VPN, and any firewall in between.", address)
+	}
+	return e
+}
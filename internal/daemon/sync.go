@@ -0,0 +1,301 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ktoks/remote/internal/protocol"
+
+	"github.com/pkg/sftp"
+)
+
+// syncDir makes a remote directory mirror the client's tree. Files are
+// compared by size and modification time (or content when requested); the
+// client then sends only the files listed in the plan.
+func (s *server) syncDir(c *clientConn, req *protocol.SyncRequest, out *bytes.Buffer) error {
+	if req == nil {
+		return errors.New("missing sync specification")
+	}
+	for _, e := range req.Entries {
+		if !validSyncPath(e.Path) {
+			return fmt.Errorf("invalid sync entry %q", e.Path)
+		}
+	}
+
+	sc, closeSFTP, err := s.sftpSession()
+	if err != nil {
+		return err
+	}
+	defer closeSFTP()
+
+	root, err := resolveRemotePath(sc, req.Path)
+	if err != nil {
+		return err
+	}
+	if !s.cfg.IsPathAllowed(root) {
+		return policyError{fmt.Errorf("path not allowed: %s", root)}
+	}
+
+	remote, err := indexRemote(sc, root)
+	if err != nil {
+		return err
+	}
+	// Security: A symlink below root could point anywhere, so refuse entries
+	// beneath one rather than write through it
+	for _, e := range req.Entries {
+		if link := symlinkedParent(remote, e.Path); link != "" {
+			return policyError{fmt.Errorf("%s is a symlink", path.Join(root, link))}
+		}
+	}
+	plan, err := planSync(sc, root, req, remote)
+	if err != nil {
+		return err
+	}
+	if err := c.encoder.EncodeJSON(protocol.TypeSyncPlan, plan); err != nil {
+		return err
+	}
+	if req.DryRun {
+		return nil
+	}
+
+	// 1. Directories
+	for _, dir := range append([]string{""}, plan.Mkdir...) {
+		if err := s.checkSyncDir(sc, root, dir); err != nil {
+			c.desynced = true
+			return err
+		}
+		if err := sc.MkdirAll(path.Join(root, dir)); err != nil {
+			c.desynced = true // The client is already streaming files
+			return fmt.Errorf("mkdir %s: %w", path.Join(root, dir), err)
+		}
+	}
+
+	// 2. Files, in plan order. A failed file is reported but the rest of
+	// the stream still has to be consumed.
+	entries := make(map[string]protocol.SyncEntry, len(req.Entries))
+	for _, e := range req.Entries {
+		entries[e.Path] = e
+	}
+	var failures []string
+	var sentFiles int
+	var sentBytes int64
+	for _, rel := range plan.Send {
+		// The tree may have changed since it was indexed
+		if err := s.checkSyncDir(sc, root, path.Dir(rel)); err != nil {
+			if _, _, _, drainErr := receiveData(c, io.Discard, nil); c.desynced {
+				return drainErr
+			}
+			failures = append(failures, err.Error())
+			continue
+		}
+		n, err := receiveSyncFile(sc, c, path.Join(root, rel), entries[rel])
+		if c.desynced {
+			return err
+		}
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		sentFiles++
+		sentBytes += n
+	}
+
+	// 3. Extras, deepest first so directories are empty when removed
+	deleted := 0
+	for _, rel := range plan.Delete {
+		full := path.Join(root, rel)
+		if err := sc.Remove(full); err != nil {
+			failures = append(failures, fmt.Sprintf("delete %s: %v", full, err))
+			continue
+		}
+		deleted++
+	}
+
+	log.Printf("Synced %s: %d sent (%d bytes), %d deleted, %d failed", root, sentFiles, sentBytes, deleted, len(failures))
+	fmt.Fprintf(out, "%s: %d file(s) sent (%d bytes), %d dir(s) created, %d deleted\n", root, sentFiles, sentBytes, len(plan.Mkdir), deleted)
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// symlinkedParent returns the first directory of rel that the remote index
+// holds as a symlink, or "" if there is none.
+func symlinkedParent(remote map[string]os.FileInfo, rel string) string {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if info, ok := remote[dir]; ok && info.Mode()&os.ModeSymlink != 0 {
+			return dir
+		}
+	}
+	return ""
+}
+
+// checkSyncDir checks each existing component of a directory below root
+// just before it is written to: none may be a symlink, and the deepest must
+// still resolve inside the allowed paths.
+func (s *server) checkSyncDir(sc *sftp.Client, root, dir string) error {
+	targets := []string{root}
+	if dir != "" && dir != "." {
+		current := root
+		for _, part := range strings.Split(dir, "/") {
+			current = path.Join(current, part)
+			targets = append(targets, current)
+		}
+	}
+
+	existing := ""
+	for _, target := range targets {
+		info, err := sc.Lstat(target)
+		if errors.Is(err, os.ErrNotExist) {
+			break // MkdirAll creates the rest
+		}
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", target, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return policyError{fmt.Errorf("%s is a symlink", target)}
+		}
+		existing = target
+	}
+	if existing == "" {
+		return nil // Nothing there yet; root was checked when resolved
+	}
+
+	real, err := sc.RealPath(existing)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", existing, err)
+	}
+	if !s.cfg.IsPathAllowed(real) {
+		return policyError{fmt.Errorf("path not allowed: %s", real)}
+	}
+	return nil
+}
+
+// indexRemote lists everything below root, keyed by slash path relative to
+// root. A missing root is an empty tree.
+func indexRemote(sc *sftp.Client, root string) (map[string]os.FileInfo, error) {
+	index := make(map[string]os.FileInfo)
+	if _, err := sc.Lstat(root); errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+
+	walker := sc.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("walk %s: %w", walker.Path(), err)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		if rel == "" {
+			continue
+		}
+		index[rel] = walker.Stat()
+		// Don't descend into symlinked directories
+		if walker.Stat().Mode()&os.ModeSymlink != 0 {
+			walker.SkipDir()
+		}
+	}
+	return index, nil
+}
+
+// planSync compares the local entries with the remote index.
+func planSync(sc *sftp.Client, root string, req *protocol.SyncRequest, remote map[string]os.FileInfo) (*protocol.SyncPlan, error) {
+	plan := &protocol.SyncPlan{}
+	local := make(map[string]bool, len(req.Entries))
+
+	for _, e := range req.Entries {
+		local[e.Path] = true
+		info, exists := remote[e.Path]
+
+		if e.Dir {
+			if !exists {
+				plan.Mkdir = append(plan.Mkdir, e.Path)
+			} else if !info.IsDir() {
+				return nil, fmt.Errorf("%s exists and is not a directory", path.Join(root, e.Path))
+			}
+			continue
+		}
+
+		if exists && info.IsDir() {
+			return nil, fmt.Errorf("%s exists and is a directory", path.Join(root, e.Path))
+		}
+		changed, err := fileChanged(sc, path.Join(root, e.Path), e, info, req.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			plan.Send = append(plan.Send, e.Path)
+		}
+	}
+
+	if req.Delete {
+		for rel := range remote {
+			if !local[rel] {
+				plan.Delete = append(plan.Delete, rel)
+			}
+		}
+		// Reverse order puts children before their parent directory
+		sort.Sort(sort.Reverse(sort.StringSlice(plan.Delete)))
+	}
+	sort.Strings(plan.Mkdir)
+	return plan, nil
+}
+
+// fileChanged reports whether a local file differs from its remote copy.
+func fileChanged(sc *sftp.Client, full string, e protocol.SyncEntry, info os.FileInfo, checksum bool) (bool, error) {
+	if info == nil || !info.Mode().IsRegular() || info.Size() != e.Size {
+		return true, nil
+	}
+	if !checksum {
+		return info.ModTime().Unix() != e.ModTime, nil
+	}
+	sum, err := remoteChecksum(sc, full)
+	if err != nil {
+		return false, fmt.Errorf("checksum %s: %w", full, err)
+	}
+	return sum != e.SHA256, nil
+}
+
+// receiveSyncFile writes one file of a sync and gives it the local mtime,
+// so the next sync sees it as unchanged.
+func receiveSyncFile(sc *sftp.Client, c *clientConn, target string, e protocol.SyncEntry) (int64, error) {
+	f, partial, err := openPartial(sc, target)
+	if err != nil {
+		_, _, _, drainErr := receiveData(c, io.Discard, nil)
+		if c.desynced {
+			return 0, drainErr
+		}
+		return 0, err
+	}
+
+	written, got, want, writeErr := receiveData(c, f, nil)
+	if close_err := f.Close(); close_err != nil && writeErr == nil {
+		writeErr = close_err
+	}
+	if writeErr == nil {
+		writeErr = commitPartial(sc, partial, target, got, want, os.FileMode(e.Mode))
+	}
+	if writeErr != nil {
+		removePartial(sc, partial)
+		return 0, fmt.Errorf("%s: %w", target, writeErr)
+	}
+
+	mtime := time.Unix(e.ModTime, 0)
+	if err := sc.Chtimes(target, mtime, mtime); err != nil {
+		return written, fmt.Errorf("set mtime %s: %w", target, err)
+	}
+	return written, nil
+}
+
+// validSyncPath rejects entries that would escape the sync root or name the
+// root itself.
+func validSyncPath(p string) bool {
+	return p != "" && p != "." && !path.IsAbs(p) && path.Clean(p) == p && p != ".." && !strings.HasPrefix(p, "../")
+}
@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ktoks/remote/internal/config"
+
+	"github.com/pkg/sftp"
+)
+
+func TestValidSyncPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"file.txt", true},
+		{"dir/file.txt", true},
+		{".hidden", true},
+		{"..data", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../escape", false},
+		{"/etc/passwd", false},
+		{"dir/../file", false},
+		{"dir/./file", false},
+		{"dir/", false},
+		{"dir//file", false},
+	}
+	for _, tt := range tests {
+		if got := validSyncPath(tt.path); got != tt.want {
+			t.Errorf("validSyncPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// newTestSFTP serves the local filesystem over an in-memory pipe.
+func newTestSFTP(t *testing.T) *sftp.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	srv, err := sftp.NewServer(serverConn)
+	if err != nil {
+		t.Fatalf("sftp.NewServer: %v", err)
+	}
+	go srv.Serve()
+
+	sc, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("sftp.NewClientPipe: %v", err)
+	}
+	t.Cleanup(func() {
+		sc.Close()
+		srv.Close()
+	})
+	return sc
+}
+
+func TestCheckSyncDir(t *testing.T) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub", "deeper"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "sub", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{cfg: &config.HostConfig{Security: &config.SecurityRules{AllowedPaths: []string{root}}}}
+	sc := newTestSFTP(t)
+
+	tests := []struct {
+		name   string
+		dir    string
+		policy bool // Refused by policy rather than allowed
+	}{
+		{"root", "", false},
+		{"dot", ".", false},
+		{"existing", "sub", false},
+		{"nested", "sub/deeper", false},
+		{"missing", "new", false},
+		{"missing below existing", "sub/new/more", false},
+		{"symlink", "link", true},
+		{"below symlink", "link/x", true},
+		{"nested symlink", "sub/link/x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.checkSyncDir(sc, root, tt.dir)
+			var policyErr policyError
+			if got := errors.As(err, &policyErr); got != tt.policy {
+				t.Errorf("checkSyncDir(%q) = %v, want policy error %v", tt.dir, err, tt.policy)
+			}
+			if !tt.policy && err != nil {
+				t.Errorf("checkSyncDir(%q) = %v, want nil", tt.dir, err)
+			}
+		})
+	}
+
+	t.Run("root outside allowed paths", func(t *testing.T) {
+		narrow := &server{cfg: &config.HostConfig{Security: &config.SecurityRules{AllowedPaths: []string{filepath.Join(root, "sub")}}}}
+		var policyErr policyError
+		if err := narrow.checkSyncDir(sc, root, ""); !errors.As(err, &policyErr) {
+			t.Errorf("checkSyncDir = %v, want policy error", err)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"github.com/ktoks/remote/internal/protocol"
+
+	"github.com/pkg/sftp"
+)
+
+// transferChunk is the size of data packets, matching SFTP's usual write size.
+const transferChunk = 32 * 1024
+
+// pushFile receives a file from the client and writes it to the remote host
+// through an SFTP session on the master. Data lands in a temporary file that
+// is only renamed into place once its checksum has been verified.
+func (s *server) pushFile(c *clientConn, t *protocol.Transfer, out *bytes.Buffer) error {
+	if t == nil {
+		return errors.New("missing transfer specification")
+	}
+	sc, closeSFTP, err := s.sftpSession()
+	if err != nil {
+		return err
+	}
+	defer closeSFTP()
+
+	target, err := resolveRemotePath(sc, t.Path)
+	if err != nil {
+		return err
+	}
+	if info, err := sc.Stat(target); err == nil && info.IsDir() {
+		name := path.Base(t.Name)
+		if name == "." || name == "/" || name == ".." {
+			return fmt.Errorf("%s is a directory", target)
+		}
+		target = path.Join(target, name)
+	}
+	if !s.cfg.IsPathAllowed(target) {
+		return policyError{fmt.Errorf("path not allowed: %s", target)}
+	}
+
+	f, partial, err := openPartial(sc, target)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			removePartial(sc, partial)
+		}
+	}()
+
+	// Go ahead: the client starts streaming once it sees the first progress report
+	if err := sendProgress(c.encoder, 0); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	written, got, want, writeErr := receiveData(c, f, func(n int64) {
+		if err := sendProgress(c.encoder, n); err != nil {
+			log.Printf("Error occured encoding PROGRESS: %v", err)
+		}
+	})
+	if close_err := f.Close(); close_err != nil && writeErr == nil {
+		writeErr = close_err
+	}
+	if writeErr != nil {
+		return fmt.Errorf("write %s: %w", partial, writeErr)
+	}
+
+	if err := commitPartial(sc, partial, target, got, want, os.FileMode(t.Mode)); err != nil {
+		return err
+	}
+	committed = true
+
+	log.Printf("Pushed %d bytes to %s", written, target)
+	fmt.Fprintf(out, "%s: %d bytes, sha256 %s\n", target, written, got)
+	return nil
+}
+
+// pullFile streams a remote file to the client, followed by its checksum.
+func (s *server) pullFile(c *clientConn, t *protocol.Transfer) error {
+	if t == nil {
+		return errors.New("missing transfer specification")
+	}
+	sc, closeSFTP, err := s.sftpSession()
+	if err != nil {
+		return err
+	}
+	defer closeSFTP()
+
+	source, err := resolveRemotePath(sc, t.Path)
+	if err != nil {
+		return err
+	}
+	if !s.cfg.IsPathAllowed(source) {
+		return policyError{fmt.Errorf("path not allowed: %s", source)}
+	}
+
+	f, err := sc.Open(source)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", source, err)
+	}
+	defer func() {
+		if close_err := f.Close(); close_err != nil {
+			log.Println("sftp file close error: ", close_err)
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", source, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", source)
+	}
+
+	meta := protocol.Transfer{Path: source, Size: info.Size(), Mode: uint32(info.Mode().Perm())}
+	if err := c.encoder.EncodeJSON(protocol.TypeFileInfo, meta); err != nil {
+		return err
+	}
+
+	sum := sha256.New()
+	if err := sendData(c.encoder, io.TeeReader(f, sum)); err != nil {
+		return fmt.Errorf("read %s: %w", source, err)
+	}
+	if err := c.encoder.Encode(protocol.TypeDataEnd, []byte(hex.EncodeToString(sum.Sum(nil)))); err != nil {
+		return err
+	}
+
+	log.Printf("Pulled %d bytes from %s", info.Size(), source)
+	return nil
+}
+
+// sftpSession checks that file transfers are enabled for the host and
+// starts an SFTP subsystem session, which holds a session slot until the
+// returned function closes it.
+func (s *server) sftpSession() (*sftp.Client, func(), error) {
+	if len(s.cfg.Rules().AllowedPaths) == 0 {
+		return nil, nil, policyError{errors.New("file transfers are disabled")}
+	}
+	client, release := s.sessions.acquire()
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		release()
+		return nil, nil, fmt.Errorf("sftp: %w", err)
+	}
+	return sc, func() {
+		if close_err := sc.Close(); close_err != nil {
+			log.Println("sftp close error: ", close_err)
+		}
+		release()
+	}, nil
+}
+
+// openPartial creates the temporary file an upload to target is written to.
+func openPartial(sc *sftp.Client, target string) (*sftp.File, string, error) {
+	partial := path.Join(path.Dir(target), "."+path.Base(target)+".part")
+	f, err := sc.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, "", fmt.Errorf("open %s: %w", partial, err)
+	}
+	return f, partial, nil
+}
+
+func removePartial(sc *sftp.Client, partial string) {
+	if rm_err := sc.Remove(partial); rm_err != nil && !errors.Is(rm_err, os.ErrNotExist) {
+		log.Println("error occurred removing partial upload: ", rm_err)
+	}
+}
+
+// receiveData copies Data packets from the client into w until DataEnd,
+// returning the byte count, the checksum of what was received and the one
+// the client sent. It keeps reading to the end even after a write error so
+// the connection stays in step with the client.
+func receiveData(c *clientConn, w io.Writer, onChunk func(int64)) (int64, string, string, error) {
+	sum := sha256.New()
+	var written int64
+	var writeErr error
+	for {
+		pkt, err := protocol.ReadPacket(c.reader)
+		if err != nil {
+			c.desynced = true
+			return written, "", "", fmt.Errorf("read upload: %w", err)
+		}
+		if pkt.Type == protocol.TypeDataEnd {
+			return written, hex.EncodeToString(sum.Sum(nil)), string(pkt.Data), writeErr
+		}
+		if pkt.Type != protocol.TypeData {
+			c.desynced = true
+			return written, "", "", fmt.Errorf("unexpected packet type %#x during upload", pkt.Type)
+		}
+		if writeErr != nil {
+			continue
+		}
+		if _, writeErr = w.Write(pkt.Data); writeErr != nil {
+			continue
+		}
+		sum.Write(pkt.Data)
+		written += int64(len(pkt.Data))
+		if onChunk != nil {
+			onChunk(written)
+		}
+	}
+}
+
+// commitPartial checks an upload against the client's checksum, both as
+// received and as re-read from disk, then renames it over target.
+func commitPartial(sc *sftp.Client, partial, target, got, want string, mode os.FileMode) error {
+	if got != want {
+		return fmt.Errorf("checksum mismatch: client sent %s, received %s", want, got)
+	}
+	if onDisk, err := remoteChecksum(sc, partial); err != nil {
+		return fmt.Errorf("verify %s: %w", partial, err)
+	} else if onDisk != want {
+		return fmt.Errorf("checksum mismatch: sent %s, remote file has %s", want, onDisk)
+	}
+
+	if mode != 0 {
+		if err := sc.Chmod(partial, mode.Perm()); err != nil {
+			return fmt.Errorf("chmod %s: %w", partial, err)
+		}
+	}
+	return renameRemote(sc, partial, target)
+}
+
+// resolveRemotePath makes p absolute and resolves symlinks so it can be
+// checked against the allowed paths. Paths that don't exist yet are
+// resolved through their parent directory.
+func resolveRemotePath(sc *sftp.Client, p string) (string, error) {
+	dir, base := path.Split(p)
+	if dir == "" {
+		dir = "."
+	}
+	realDir, err := sc.RealPath(dir)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", dir, err)
+	}
+
+	full := path.Join(realDir, base)
+	if info, err := sc.Lstat(full); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if full, err = sc.RealPath(full); err != nil {
+			return "", fmt.Errorf("resolve %s: %w", p, err)
+		}
+	}
+	return full, nil
+}
+
+// remoteChecksum re-reads a remote file and returns its hex SHA-256.
+func remoteChecksum(sc *sftp.Client, p string) (string, error) {
+	f, err := sc.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if close_err := f.Close(); close_err != nil {
+			log.Println("sftp file close error: ", close_err)
+		}
+	}()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// renameRemote moves src over dst, using the atomic POSIX rename extension
+// when the server supports it.
+func renameRemote(sc *sftp.Client, src, dst string) error {
+	if _, ok := sc.HasExtension("posix-rename@openssh.com"); ok {
+		if err := sc.PosixRename(src, dst); err != nil {
+			return fmt.Errorf("rename %s: %w", dst, err)
+		}
+		return nil
+	}
+	if err := sc.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("replace %s: %w", dst, err)
+	}
+	if err := sc.Rename(src, dst); err != nil {
+		return fmt.Errorf("rename %s: %w", dst, err)
+	}
+	return nil
+}
+
+// sendData streams r to the client as data packets.
+func sendData(enc *protocol.Encoder, r io.Reader) error {
+	buf := make([]byte, transferChunk)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if enc_err := enc.Encode(protocol.TypeData, buf[:n]); enc_err != nil {
+				return enc_err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func sendProgress(enc *protocol.Encoder, n int64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return enc.Encode(protocol.TypeProgress, b)
+}
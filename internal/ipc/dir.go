@@ -0,0 +1,31 @@
+package ipc
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// EnsurePrivateDir creates dir with mode 0700 if needed, then checks that it
+// is a real directory owned by the current user that no one else can use.
+// Sockets and locks are only trusted inside such a directory, since anyone
+// able to write to it could plant a socket of their own.
+func EnsurePrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not the current user", dir, st.Uid)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		return fmt.Errorf("%s has mode %#o, expected 0700 (chmod 700 %s)", dir, perm, dir)
+	}
+	return nil
+}
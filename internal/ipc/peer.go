@@ -0,0 +1,14 @@
+package ipc
+
+import "errors"
+
+// ErrNoPeerCredentials is returned where the platform can't identify the
+// process on the other end of a socket.
+var ErrNoPeerCredentials = errors.New("peer credentials are not supported on this platform")
+
+// Peer identifies the process connected to a daemon socket.
+type Peer struct {
+	PID int
+	UID int
+	GID int
+}
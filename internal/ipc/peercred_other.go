@@ -0,0 +1,15 @@
+//go:build !linux
+
+package ipc
+
+import "net"
+
+// PeerCredentials is only implemented on Linux.
+func PeerCredentials(conn net.Conn) (*Peer, error) {
+	return nil, ErrNoPeerCredentials
+}
+
+// Executable is only implemented on Linux.
+func (p *Peer) Executable() (string, error) {
+	return processExecutable(p.PID)
+}
@@ -0,0 +1,31 @@
+package ipc
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processExecutable returns the path of the program pid is running. A
+// program replaced since it started (e.g. by an upgrade) still counts.
+func processExecutable(pid int) (string, error) {
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// processArgs returns the command line pid was started with.
+func processArgs(pid int) ([]string, error) {
+	cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, arg := range bytes.Split(bytes.TrimSuffix(cmdline, []byte{0}), []byte{0}) {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package ipc
+
+import "errors"
+
+var errNoProc = errors.New("process inspection is not supported on this platform")
+
+// processExecutable is only implemented on Linux, so daemons are never
+// killed elsewhere.
+func processExecutable(pid int) (string, error) {
+	return "", errNoProc
+}
+
+func processArgs(pid int) ([]string, error) {
+	return nil, errNoProc
+}
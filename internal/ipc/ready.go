@@ -0,0 +1,68 @@
+package ipc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ktoks/remote/internal/protocol"
+)
+
+// ErrLocked is returned by AcquireLock when another daemon holds the lock.
+var ErrLocked = errors.New("another instance is running")
+
+// Startup results a spawned daemon writes to the pipe its client passes it,
+// so the client waits exactly until the daemon can take connections.
+const (
+	StartReady = "ready" // Listening on the socket
+	StartBusy  = "busy"  // Lost the race to another daemon, which will listen instead
+
+	startFailed = "error: " // Followed by a JSON protocol.StartupError
+)
+
+// NotifyStarted writes the daemon's startup result to the spawning client and
+// closes the pipe. It does nothing when the daemon wasn't given one.
+func NotifyStarted(f *os.File, result string) {
+	if f == nil {
+		return
+	}
+	if _, err := io.WriteString(f, result); err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred writing startup result: %s", err)
+	}
+	if close_err := f.Close(); close_err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred closing startup pipe: %s", close_err)
+	}
+}
+
+// NotifyFailed reports why the daemon could not start.
+func NotifyFailed(f *os.File, startErr *protocol.StartupError) {
+	data, err := json.Marshal(startErr)
+	if err != nil {
+		data = []byte(`{"message":"daemon failed to start"}`)
+	}
+	NotifyStarted(f, startFailed+string(data))
+}
+
+// ReadStarted waits for the spawned daemon's startup result, returning the
+// daemon's own *protocol.StartupError when it failed to start.
+func ReadStarted(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("reading daemon startup result: %w", err)
+	}
+	result := string(data)
+	if reason, ok := strings.CutPrefix(result, startFailed); ok {
+		var startErr protocol.StartupError
+		if err := json.Unmarshal([]byte(reason), &startErr); err != nil {
+			return "", fmt.Errorf("invalid startup error from daemon: %w", err)
+		}
+		return "", &startErr
+	}
+	if result != StartReady && result != StartBusy {
+		return "", fmt.Errorf("daemon exited during startup")
+	}
+	return result, nil
+}
@@ -1,11 +1,14 @@
 package ipc
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -25,16 +28,25 @@ func AcquireLock(lockPath string) (*os.File, error) {
 
 	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
 		if close_err := f.Close(); close_err != nil {
-			fmt.Printf("Error occurred closing Unix Socket: %s", close_err)
+			fmt.Fprintf(os.Stderr, "Error occurred closing Unix Socket: %s\n", close_err)
 		}
-		return nil, fmt.Errorf("cannot acquire lock, another instance may be running: %w", err)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			err = ErrLocked
+		}
+		return nil, fmt.Errorf("cannot acquire lock: %w", err)
 	}
 
-	// Write PID to lock file
+	// Write PID to lock file, replacing any left by a daemon that crashed
+	if err := f.Truncate(0); err != nil {
+		if close_err := f.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred closing Unix Socket: %s\n", close_err)
+		}
+		return nil, fmt.Errorf("failed to truncate lock file: %w", err)
+	}
 	pid := os.Getpid()
 	if _, err := f.WriteString(strconv.Itoa(pid)); err != nil {
 		if close_err := f.Close(); close_err != nil {
-			fmt.Printf("Error occurred closing Unix Socket: %s", close_err)
+			fmt.Fprintf(os.Stderr, "Error occurred closing Unix Socket: %s\n", close_err)
 		}
 		return nil, fmt.Errorf("failed to write PID to lock file: %w", err)
 	}
@@ -42,41 +54,119 @@ func AcquireLock(lockPath string) (*os.File, error) {
 	return f, nil
 }
 
-// CheckAndCleanLock checks for and cleans up stale or zombie lock files.
-func CheckAndCleanLock(lockPath, socketPath string) {
-	// 1. Check if lock file exists. If not, nothing to do.
-	if _, err := os.Stat(lockPath); os.IsNotExist(err) {
-		return
+// CheckAndCleanLock clears what a previous daemon left behind when nothing
+// answers on socketPath. The lock is the source of truth for whether a daemon
+// is running: one nobody holds means the socket is stale, while a holder that
+// still doesn't answer pings is killed, but only after /proc confirms it is a
+// daemon for identity. It reports whether a live daemon answered after all.
+func CheckAndCleanLock(lockPath, socketPath, identity string) (bool, error) {
+	f, err := os.OpenFile(lockPath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		removeStaleSocket(socketPath)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if close_err := f.Close(); close_err != nil {
+			fmt.Fprintf(os.Stderr, "Error occurred closing lock file: %s\n", close_err)
+		}
+	}()
+
+	// 1. Nobody holds the lock: the daemon is gone. The socket is removed
+	// while we hold it so a daemon starting now can't lose its new one.
+	if tryLock(f) {
+		removeStaleSocket(socketPath)
+		unlock(f)
+		return false, nil
+	}
+
+	// 2. The lock is held. A daemon that just started may not be listening
+	// yet, so give it a moment to answer.
+	for range 10 {
+		if Ping(socketPath) {
+			return true, nil
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
 
-	// 2. Read PID from lock file.
+	// 3. The holder never answered. Make sure it is one of ours first.
 	pid, err := readPIDFromLock(lockPath)
 	if err != nil {
-		// Lock file is corrupt or unreadable, remove it.
-		_ = os.Remove(lockPath)
-		return
+		return false, err
+	}
+	if !isDaemon(pid, identity) {
+		return false, fmt.Errorf("lock %s is held by process %d, which is not a daemon for %s", lockPath, pid, identity)
 	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		return false, fmt.Errorf("failed to kill unresponsive daemon %d: %w", pid, err)
+	}
+	fmt.Fprintf(os.Stderr, "Killed unresponsive daemon process with PID %d\n", pid)
 
-	// 3. Check if the process is actually running.
-	process, err := os.FindProcess(pid)
-	if err != nil || process == nil {
-		// Process not found, lock is stale.
-		_ = os.Remove(lockPath)
-		return
+	// The kernel drops the lock once the process is gone
+	for range 20 {
+		if tryLock(f) {
+			removeStaleSocket(socketPath)
+			unlock(f)
+			return false, nil
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
-	// On Unix, we send signal 0 to check for process existence.
-	if err := process.Signal(syscall.Signal(0)); err != nil {
-		// Process is not running, lock is stale.
-		_ = os.Remove(lockPath)
-		return
+	return false, fmt.Errorf("daemon %d still holds %s after being killed", pid, lockPath)
+}
+
+// Ping reports whether a daemon accepts connections on socketPath.
+func Ping(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return false
+	}
+	if close_err := conn.Close(); close_err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred closing Unix Socket: %s\n", close_err)
 	}
+	return true
+}
 
-	// 4. Process is running. Check if it's a zombie (socket is gone).
-	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
-		// Zombie process. Kill it and clean up the lock.
-		_ = process.Kill()
-		time.Sleep(100 * time.Millisecond) // Give it a moment to die.
-		_ = os.Remove(lockPath)
+// isDaemon reports whether pid is this program running as the daemon for
+// identity, so an unrelated process that reused the PID is never killed.
+func isDaemon(pid int, identity string) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	if self, err = filepath.EvalSymlinks(self); err != nil {
+		return false
+	}
+	exe, err := processExecutable(pid)
+	if err != nil || exe != self {
+		return false
+	}
+	args, err := processArgs(pid)
+	if err != nil {
+		return false
+	}
+	for i := 1; i+1 < len(args); i++ {
+		if (args[i] == "--daemon" || args[i] == "-daemon") && args[i+1] == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func tryLock(f *os.File) bool {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil
+}
+
+func unlock(f *os.File) {
+	if lock_err := unix.Flock(int(f.Fd()), unix.LOCK_UN); lock_err != nil {
+		fmt.Fprintf(os.Stderr, "Error occurred unlocking Unix Socket: %s\n", lock_err)
+	}
+}
+
+func removeStaleSocket(socketPath string) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error occurred removing stale socket: %s\n", err)
 	}
 }
 
@@ -86,14 +176,13 @@ func readPIDFromLock(lockPath string) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("failed to read PID from lock: %w", err)
 	}
-	pid, err := strconv.Atoi(string(pidBytes))
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse PID from lock: %w", err)
 	}
 	return pid, nil
 }
 
-
 // ReleaseLock unlocks and closes the file.
 func ReleaseLock(f *os.File) {
 	if f == nil {
@@ -101,12 +190,12 @@ func ReleaseLock(f *os.File) {
 	}
 	// Truncate file before releasing lock
 	if err := f.Truncate(0); err != nil {
-		fmt.Printf("Error truncating lock file: %s", err)
+		fmt.Fprintf(os.Stderr, "Error truncating lock file: %s\n", err)
 	}
 	if lock_err := unix.Flock(int(f.Fd()), unix.LOCK_UN); lock_err != nil {
-		fmt.Printf("Error occurred unlocking Unix Socket: %s", lock_err)
+		fmt.Fprintf(os.Stderr, "Error occurred unlocking Unix Socket: %s\n", lock_err)
 	}
 	if close_err := f.Close(); close_err != nil {
-		fmt.Printf("Error occurred closing Unix Socket: %s", close_err)
+		fmt.Fprintf(os.Stderr, "Error occurred closing Unix Socket: %s\n", close_err)
 	}
 }
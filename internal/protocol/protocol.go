@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"sync"
@@ -9,11 +10,232 @@ import (
 
 // Packet Types
 const (
-	TypeStdout = 0x01
-	TypeStderr = 0x02
-	TypeExit   = 0x03
+	TypeStdout  = 0x01
+	TypeStderr  = 0x02
+	TypeExit    = 0x03
+	TypeReady   = 0x04 // Daemon -> client: master connection is up, commands may follow
+	TypePrompt  = 0x05 // Daemon -> client: question for the user (JSON Prompt)
+	TypeReply   = 0x06 // Client -> daemon: answer to a prompt (JSON Reply)
+	TypeControl = 0x07 // Client -> daemon: daemon control request (JSON Control), answered with Stdout/Stderr/Exit
+
+	// File transfers. Data flows from whichever side holds the file.
+	TypeData     = 0x08 // File contents chunk
+	TypeDataEnd  = 0x09 // End of file contents; payload is the hex SHA-256 of all chunks
+	TypeProgress = 0x0A // Daemon -> client: bytes written remotely so far (uint64)
+	TypeFileInfo = 0x0B // Daemon -> client: file about to be sent (JSON Transfer)
+	TypeSyncPlan = 0x0C // Daemon -> client: what a sync will change (JSON SyncPlan)
+
+	// 0x0D is skipped: it would be read as whitespace before a plain-text command
+	TypeRequest = 0x0E // Client -> daemon: command with options (see Request), answered like a command line
+
+	TypeStartupError = 0x0F // Daemon -> client: why it can't serve commands (JSON StartupError), followed by Stderr/Exit for older clients
+	TypeHello        = 0x10 // Client -> agent: the host this connection addresses (JSON Hello); must come first
+	TypeRejected     = 0x11 // Daemon -> client: the host's security rules refused the request; payload is the reason. Followed by Stderr/Exit for older clients
+)
+
+// Control operations
+const (
+	OpForward       = "forward"        // Start the port forward in Control.Forward
+	OpListForwards  = "list-forwards"  // List active port forwards
+	OpCancelForward = "cancel-forward" // Stop the port forward with Control.ID
+	OpPush          = "push"           // Upload Control.Transfer; the daemon answers with Progress, then Data follows
+	OpPull          = "pull"           // Download Control.Transfer; the daemon answers with FileInfo, Data, DataEnd
+	OpSync          = "sync"           // Mirror a directory per Control.Sync; the daemon answers with SyncPlan, then files in Send follow
+	OpScript        = "script"         // Run Control.Script on the remote interpreter; replies like a command
+)
+
+// RequestVersion is the layout of the request packets this build sends.
+// Version 1 options are RequestOptions as JSON.
+const RequestVersion = 1
+
+// Request runs one command with per-command options. It replaces the
+// newline-terminated command line, which daemons still accept from older
+// clients, so commands may contain newlines (heredocs, multi-line scripts).
+//
+// The packet payload is a version byte, the command's length (uint32) and
+// bytes, then the version's options payload.
+type Request struct {
+	Command string
+	Options RequestOptions
+}
+
+// RequestOptions are the per-command settings carried in a request.
+type RequestOptions struct {
+	TimeoutMS int64             `json:"timeout_ms,omitempty"` // Kill the command after this long; the host may impose a shorter limit
+	Env       map[string]string `json:"env,omitempty"`        // Environment variables to set in the remote session
+	SendEnv   map[string]string `json:"send_env,omitempty"`   // Variables from the host's send_env; any the host refuses are skipped
+	Dir       string            `json:"dir,omitempty"`        // Remote working directory; defaults to the host's default_dir
+}
+
+// EncodeRequest writes req as a request packet.
+func (e *Encoder) EncodeRequest(req Request) error {
+	options, err := json.Marshal(req.Options)
+	if err != nil {
+		return fmt.Errorf("marshal options: %w", err)
+	}
+
+	data := make([]byte, 5, 5+len(req.Command)+len(options))
+	data[0] = RequestVersion
+	binary.BigEndian.PutUint32(data[1:], uint32(len(req.Command)))
+	data = append(data, req.Command...)
+	data = append(data, options...)
+	return e.Encode(TypeRequest, data)
+}
+
+// DecodeRequest parses a request packet's payload. Requests from newer
+// clients are refused rather than run with options silently dropped.
+func DecodeRequest(data []byte) (*Request, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("request too short")
+	}
+	if version := data[0]; version == 0 || version > RequestVersion {
+		return nil, fmt.Errorf("unsupported request version %d (daemon supports up to %d; restart it to upgrade)", version, RequestVersion)
+	}
+
+	cmdLen := binary.BigEndian.Uint32(data[1:5])
+	if uint64(cmdLen) > uint64(len(data)-5) {
+		return nil, fmt.Errorf("request command length %d exceeds payload", cmdLen)
+	}
+	req := &Request{Command: string(data[5 : 5+cmdLen])}
+
+	if options := data[5+cmdLen:]; len(options) > 0 {
+		if err := json.Unmarshal(options, &req.Options); err != nil {
+			return nil, fmt.Errorf("invalid request options: %w", err)
+		}
+	}
+	return req, nil
+}
+
+// ExitTimeout is the exit code reported for a command killed for running
+// too long, matching timeout(1).
+const ExitTimeout = 124
+
+// ExitBusy is the exit code reported for a command refused because the
+// host's command limits were reached, EX_TEMPFAIL from sysexits.h: the
+// command didn't run and may be retried later.
+const ExitBusy = 75
+
+// Control asks the daemon to act on its master connection rather than run
+// a command. Clients send it in place of a command line.
+type Control struct {
+	Op       string       `json:"op"`
+	ID       int          `json:"id,omitempty"`
+	Forward  *Forward     `json:"forward,omitempty"`
+	Transfer *Transfer    `json:"transfer,omitempty"`
+	Sync     *SyncRequest `json:"sync,omitempty"`
+	Script   *Script      `json:"script,omitempty"`
+}
+
+// Script is a local script run on the host by feeding it to the remote
+// interpreter's stdin.
+type Script struct {
+	Body string   `json:"body"`
+	Args []string `json:"args,omitempty"` // Positional parameters ($1, $2, ...)
+
+	Options RequestOptions `json:"options,omitzero"` // Applied as they are to a command
+}
+
+// Transfer describes a file copied over the master connection.
+type Transfer struct {
+	Path string `json:"path"`           // Remote path; a directory means "into this directory"
+	Name string `json:"name,omitempty"` // Base name to use when Path is a directory
+	Size int64  `json:"size"`
+	Mode uint32 `json:"mode,omitempty"` // Permission bits
+}
+
+// SyncRequest asks the daemon to make a remote directory mirror a local
+// tree described by Entries.
+type SyncRequest struct {
+	Path     string      `json:"path"`     // Remote root directory
+	Delete   bool        `json:"delete"`   // Remove remote entries missing locally
+	Checksum bool        `json:"checksum"` // Compare contents, not just size and mtime
+	DryRun   bool        `json:"dry_run"`  // Only report the plan
+	Entries  []SyncEntry `json:"entries"`
+}
+
+// SyncEntry is a file or directory in the local tree.
+type SyncEntry struct {
+	Path    string `json:"path"` // Slash-separated, relative to the root
+	Dir     bool   `json:"dir,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"` // Unix seconds
+	Mode    uint32 `json:"mode,omitempty"`
+	SHA256  string `json:"sha256,omitempty"` // Only with Checksum
+}
+
+// SyncPlan lists the changes a sync makes, as paths relative to the root.
+// The client sends the files in Send, in order, as Data/DataEnd sequences.
+type SyncPlan struct {
+	Mkdir  []string `json:"mkdir,omitempty"`
+	Send   []string `json:"send,omitempty"`
+	Delete []string `json:"delete,omitempty"`
+}
+
+// Forward kinds
+const (
+	ForwardLocal   = "local"   // Listen locally, connect from the remote host (ssh -L)
+	ForwardRemote  = "remote"  // Listen on the remote host, connect locally (ssh -R)
+	ForwardDynamic = "dynamic" // Local SOCKS5 proxy, connect from the remote host (ssh -D)
 )
 
+// Forward describes a port forward over the master connection.
+type Forward struct {
+	ID     int    `json:"id,omitempty"`
+	Kind   string `json:"kind"`
+	Listen string `json:"listen"` // host:port the listener binds
+	Target string `json:"target"` // host:port accepted connections are proxied to, unused for dynamic
+}
+
+// Prompt asks the user at the client's terminal to answer questions the
+// daemon cannot answer itself, e.g. whether to trust an unknown host key.
+type Prompt struct {
+	Instruction string     `json:"instruction,omitempty"`
+	Questions   []Question `json:"questions"`
+}
+
+// Question is a single prompt line. Echo is false for secrets such as
+// passwords and one-time codes.
+type Question struct {
+	Text string `json:"text"`
+	Echo bool   `json:"echo"`
+}
+
+// Reply carries the user's answers, in question order. A nil Answers means
+// the client could not ask (no terminal) and the prompt is declined.
+type Reply struct {
+	Answers []string `json:"answers"`
+}
+
+// Hello opens a connection to the agent, which serves every host from one
+// daemon, by naming the host the connection's requests are for.
+type Hello struct {
+	Host string `json:"host"`
+}
+
+// Startup error kinds
+const (
+	StartupConfig  = "config"   // The configuration couldn't be loaded or used
+	StartupHostKey = "host_key" // The host's key couldn't be verified
+	StartupAuth    = "auth"     // The host rejected every authentication method
+	StartupNetwork = "network"  // The host couldn't be reached
+	StartupOther   = "other"
+)
+
+// StartupError tells the client why the daemon couldn't start or connect
+// to the host, and what the user can do about it.
+type StartupError struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	Remedy  string `json:"remedy,omitempty"`
+}
+
+func (e *StartupError) Error() string {
+	if e.Remedy == "" {
+		return e.Message
+	}
+	return e.Message + "\n" + e.Remedy
+}
+
 // Packet represents a decoded message.
 type Packet struct {
 	Type uint8
@@ -55,43 +277,78 @@ func (e *Encoder) Encode(pType uint8, data []byte) error {
 	return nil
 }
 
+// EncodeJSON marshals v and writes it as the payload of a packet.
+func (e *Encoder) EncodeJSON(pType uint8, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	return e.Encode(pType, data)
+}
+
+// ReadPacket reads a single packet. It returns io.EOF if the stream ends
+// cleanly before a header.
+func ReadPacket(r io.Reader) (*Packet, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	pkt := &Packet{Type: header[0]}
+	pLen := binary.BigEndian.Uint32(header[1:])
+
+	if pLen > 0 {
+		pkt.Data = make([]byte, pLen)
+		if _, err := io.ReadFull(r, pkt.Data); err != nil {
+			return nil, fmt.Errorf("read payload: %w", err)
+		}
+	}
+
+	if pkt.Type == TypeExit {
+		if len(pkt.Data) < 4 {
+			return nil, fmt.Errorf("short exit packet")
+		}
+		pkt.Code = binary.BigEndian.Uint32(pkt.Data)
+	}
+	return pkt, nil
+}
+
 // DecodeLoop reads from the reader and executes callbacks based on packet type.
 // It returns when EOF is reached or an error occurs.
 func DecodeLoop(r io.Reader, onStdout, onStderr func([]byte), onExit func(int) bool) error {
-	header := make([]byte, 5)
+	return DecodeReply(r, onStdout, onStderr, nil, onExit)
+}
 
+// DecodeReply is DecodeLoop that also reports a policy rejection.
+func DecodeReply(r io.Reader, onStdout, onStderr func([]byte), onRejected func(string), onExit func(int) bool) error {
 	for {
-		if _, err := io.ReadFull(r, header); err != nil {
+		pkt, err := ReadPacket(r)
+		if err != nil {
 			if err == io.EOF {
 				return nil
 			}
-			return fmt.Errorf("read header: %w", err)
+			return err
 		}
 
-		pType := header[0]
-		pLen := binary.BigEndian.Uint32(header[1:])
-
-		var payload []byte
-		if pLen > 0 {
-			payload = make([]byte, pLen)
-			if _, err := io.ReadFull(r, payload); err != nil {
-				return fmt.Errorf("read payload: %w", err)
-			}
-		}
-
-		switch pType {
+		switch pkt.Type {
 		case TypeStdout:
 			if onStdout != nil {
-				onStdout(payload)
+				onStdout(pkt.Data)
 			}
 		case TypeStderr:
 			if onStderr != nil {
-				onStderr(payload)
+				onStderr(pkt.Data)
+			}
+		case TypeRejected:
+			if onRejected != nil {
+				onRejected(string(pkt.Data))
 			}
 		case TypeExit:
-			code := int(binary.BigEndian.Uint32(payload))
 			if onExit != nil {
-				shouldStop := onExit(code)
+				shouldStop := onExit(int(pkt.Code))
 				if shouldStop {
 					return nil
 				}
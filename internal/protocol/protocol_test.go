@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+	}{
+		{"plain", Request{Command: "ls -l"}},
+		{"empty command", Request{}},
+		{"multi-line", Request{Command: "cat <<EOF\nhello\nEOF"}},
+		{"options", Request{Command: "make", Options: RequestOptions{
+			TimeoutMS: 30000,
+			Env:       map[string]string{"APP_MODE": "staging"},
+			SendEnv:   map[string]string{"LANG": "C.UTF-8"},
+			Dir:       "/srv/app",
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).EncodeRequest(tt.req); err != nil {
+				t.Fatalf("EncodeRequest: %v", err)
+			}
+			pkt, err := ReadPacket(&buf)
+			if err != nil {
+				t.Fatalf("ReadPacket: %v", err)
+			}
+			if pkt.Type != TypeRequest {
+				t.Fatalf("packet type = %#x, want %#x", pkt.Type, TypeRequest)
+			}
+			got, err := DecodeRequest(pkt.Data)
+			if err != nil {
+				t.Fatalf("DecodeRequest: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.req) {
+				t.Errorf("DecodeRequest = %+v, want %+v", *got, tt.req)
+			}
+		})
+	}
+}
+
+// rawRequest builds a request payload with the given version, declared
+// command length and bytes that follow it.
+func rawRequest(version byte, cmdLen uint32, rest string) []byte {
+	data := make([]byte, 5, 5+len(rest))
+	data[0] = version
+	binary.BigEndian.PutUint32(data[1:], cmdLen)
+	return append(data, rest...)
+}
+
+func TestDecodeRequestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "too short"},
+		{"truncated header", []byte{RequestVersion, 0, 0}, "too short"},
+		{"version zero", rawRequest(0, 2, "ls"), "unsupported request version"},
+		{"newer version", rawRequest(RequestVersion+1, 2, "ls"), "unsupported request version"},
+		{"length past payload", rawRequest(RequestVersion, 10, "ls"), "exceeds payload"},
+		{"oversized length", rawRequest(RequestVersion, 0xFFFFFFFF, "ls"), "exceeds payload"},
+		{"truncated command", rawRequest(RequestVersion, 3, "ls"), "exceeds payload"},
+		{"invalid options", rawRequest(RequestVersion, 2, "ls{"), "invalid request options"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := DecodeRequest(tt.data)
+			if err == nil {
+				t.Fatalf("DecodeRequest = %+v, want error containing %q", req, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("DecodeRequest error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}